@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// accessMode controls which directions the remote cache is used in.
+// The local cache is always used.
+type accessMode int
+
+const (
+	accessReadWrite accessMode = iota
+	accessReadOnly
+	accessWriteOnly
+	accessOff
+)
+
+func (m accessMode) String() string {
+	switch m {
+	case accessReadWrite:
+		return "read-write"
+	case accessReadOnly:
+		return "read-only"
+	case accessWriteOnly:
+		return "write-only"
+	case accessOff:
+		return "off"
+	default:
+		return fmt.Sprintf("accessMode(%d)", int(m))
+	}
+}
+
+// canRead reports whether objects may be fetched from the remote cache.
+func (m accessMode) canRead() bool {
+	return m == accessReadWrite || m == accessReadOnly
+}
+
+// canWrite reports whether objects may be uploaded to the remote cache.
+func (m accessMode) canWrite() bool {
+	return m == accessReadWrite || m == accessWriteOnly
+}
+
+func parseAccessMode(s string) (accessMode, error) {
+	switch strings.ToLower(s) {
+	case "read-write", "readwrite", "rw":
+		return accessReadWrite, nil
+	case "read-only", "readonly", "read", "ro":
+		return accessReadOnly, nil
+	case "write-only", "writeonly", "write", "wo":
+		return accessWriteOnly, nil
+	case "off", "none", "disabled":
+		return accessOff, nil
+	default:
+		return 0, fmt.Errorf("unknown access mode %q", s)
+	}
+}
+
+const (
+	githubEventName = "GITHUB_EVENT_NAME"
+	githubEventPath = "GITHUB_EVENT_PATH"
+	githubRef       = "GITHUB_REF"
+)
+
+// detectForkPR reports whether the workflow was triggered by a pull request
+// from a fork, based on the event payload provided by the runner.
+func detectForkPR() bool {
+	switch os.Getenv(githubEventName) {
+	case "pull_request", "pull_request_target", "pull_request_review", "pull_request_review_comment":
+	default:
+		return false
+	}
+
+	dt, err := os.ReadFile(os.Getenv(githubEventPath))
+	if err != nil {
+		return false
+	}
+
+	type repo struct {
+		FullName string `json:"full_name"`
+	}
+	var event struct {
+		PullRequest *struct {
+			Head struct {
+				Repo *repo `json:"repo"`
+			} `json:"head"`
+			Base struct {
+				Repo *repo `json:"repo"`
+			} `json:"base"`
+		} `json:"pull_request"`
+	}
+	if err := json.Unmarshal(dt, &event); err != nil || event.PullRequest == nil {
+		return false
+	}
+
+	head, base := event.PullRequest.Head.Repo, event.PullRequest.Base.Repo
+	if head == nil {
+		// The head repository was deleted, which can only happen for forks.
+		return true
+	}
+	// The head repository being a fork says nothing on its own, pull
+	// requests between two branches of a forked repository are not from a
+	// fork.
+	return base != nil && head.FullName != base.FullName
+}
+
+// canWriteScope reports whether the cache token allows writing to the scope
+// of the current ref. If the current ref is not one of the token scopes, any
+// writable scope is accepted.
+func canWriteScope(scopes []actionscache.Scope, ref string) bool {
+	if len(scopes) == 0 {
+		// Nothing to go on, let the service decide.
+		return true
+	}
+
+	if ref != "" {
+		for _, s := range scopes {
+			if s.Scope == ref {
+				return s.Permission&actionscache.PermissionWrite != 0
+			}
+		}
+	}
+
+	for _, s := range scopes {
+		if s.Permission&actionscache.PermissionWrite != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultAccessMode picks the access mode to use when none is configured.
+// It returns the mode along with a reason when the mode is restricted.
+func defaultAccessMode(client *actionscache.Cache) (accessMode, string) {
+	if detectForkPR() {
+		return accessReadOnly, "pull request from a fork"
+	}
+	if !canWriteScope(client.Scopes(), os.Getenv(githubRef)) {
+		return accessReadOnly, "cache token has no write permission for the current scope"
+	}
+	return accessReadWrite, ""
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// concatBlob is an [actionscache.Blob] that presents a header followed by the
+// contents of one or more local files as a single contiguous blob.
+type concatBlob struct {
+	parts []io.ReaderAt
+	ends  []int64 // cumulative end offset of each part
+	files []*os.File
+	temps []string // files to remove on Close
+}
+
+func newConcatBlob(header []byte) *concatBlob {
+	b := &concatBlob{}
+	b.add(bytes.NewReader(header), int64(len(header)))
+	return b
+}
+
+// addFile appends the first size bytes of the file at path to the blob.
+func (b *concatBlob) addFile(path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening local cache file: %w", err)
+	}
+	b.files = append(b.files, f)
+	b.add(f, size)
+	return nil
+}
+
+// addObject appends an encoded object to the blob, taking ownership of its
+// file if it is temporary.
+func (b *concatBlob) addObject(obj encodedObject) error {
+	if obj.temp {
+		b.temps = append(b.temps, obj.path)
+	}
+	return b.addFile(obj.path, obj.size)
+}
+
+func (b *concatBlob) add(r io.ReaderAt, size int64) {
+	b.parts = append(b.parts, r)
+	b.ends = append(b.ends, b.Size()+size)
+}
+
+func (b *concatBlob) Size() int64 {
+	if len(b.ends) == 0 {
+		return 0
+	}
+	return b.ends[len(b.ends)-1]
+}
+
+func (b *concatBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.Size() {
+		return 0, io.EOF
+	}
+
+	i := sort.Search(len(b.ends), func(i int) bool { return b.ends[i] > off })
+
+	var n int
+	for ; i < len(b.parts) && len(p) > 0; i++ {
+		var start int64
+		if i > 0 {
+			start = b.ends[i-1]
+		}
+
+		want := min(int64(len(p)), b.ends[i]-off)
+		nn, err := b.parts[i].ReadAt(p[:want], off-start)
+		n += nn
+		off += int64(nn)
+		p = p[nn:]
+		if err != nil && (err != io.EOF || int64(nn) < want) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *concatBlob) Close() error {
+	for _, f := range b.files {
+		f.Close()
+	}
+	for _, p := range b.temps {
+		os.Remove(p)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConcatBlobReadAt(t *testing.T) {
+	dir := t.TempDir()
+	parts := []string{"first file", "", "second", "x"}
+
+	b := newConcatBlob([]byte("header:"))
+	want := []byte("header:")
+	for i, content := range parts {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		// The file is longer than the part, only size bytes belong to the
+		// blob.
+		if err := os.WriteFile(path, []byte(content+"-trailing"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.addFile(path, int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, content...)
+	}
+	defer b.Close()
+
+	if b.Size() != int64(len(want)) {
+		t.Fatalf("got size %d, want %d", b.Size(), len(want))
+	}
+
+	tests := []struct {
+		name    string
+		off     int64
+		n       int
+		wantErr error
+	}{
+		{"header", 0, 3, nil},
+		{"header to file", 4, 6, nil},
+		{"within file", 8, 4, nil},
+		{"across empty file", 14, 8, nil},
+		{"across all", 0, len(want), nil},
+		{"last byte", int64(len(want) - 1), 1, nil},
+		{"past end", int64(len(want) - 2), 5, io.EOF},
+		{"at end", int64(len(want)), 1, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make([]byte, tt.n)
+			n, err := b.ReadAt(p, tt.off)
+			if err != tt.wantErr {
+				t.Fatalf("ReadAt(%d, %d): got error %v, want %v", tt.n, tt.off, err, tt.wantErr)
+			}
+			end := min(tt.off+int64(tt.n), int64(len(want)))
+			wantBytes := want[min(tt.off, end):end]
+			if !bytes.Equal(p[:n], wantBytes) {
+				t.Errorf("ReadAt(%d, %d) = %q, want %q", tt.n, tt.off, p[:n], wantBytes)
+			}
+		})
+	}
+
+	// Reading the blob sequentially, as uploads do, gives back the whole
+	// content.
+	got, err := io.ReadAll(io.NewSectionReader(b, 0, b.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConcatBlobShortFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short")
+	if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newConcatBlob([]byte("h"))
+	if err := b.addFile(path, 10); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	p := make([]byte, 11)
+	n, err := b.ReadAt(p, 0)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if string(p[:n]) != "habc" {
+		t.Errorf("got %q, want %q", p[:n], "habc")
+	}
+}
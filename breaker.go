@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+const (
+	defaultBreakerThreshold     = 5
+	defaultBreakerProbeInterval = time.Minute
+)
+
+// errBreakerOpen is returned for remote operations that were not attempted
+// because the remote cache is failing.
+var errBreakerOpen = errors.New("remote cache is unavailable")
+
+// breaker stops using the remote cache once it keeps failing, so that a slow
+// or broken cache service does not hold up the build.
+//
+// After threshold consecutive failures the breaker opens and remote
+// operations are skipped, which leaves only the local cache. Every
+// probeInterval a single operation is let through to check whether the
+// service has recovered.
+type breaker struct {
+	threshold     int
+	probeInterval time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	probing   bool
+	nextProbe time.Time
+	warned    bool
+}
+
+func newBreaker(threshold int, probeInterval time.Duration) *breaker {
+	return &breaker{threshold: threshold, probeInterval: probeInterval}
+}
+
+// allow reports whether a remote operation may be attempted. When it returns
+// true, the outcome must be reported with done.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+	if b.probing || time.Now().Before(b.nextProbe) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the outcome of a remote operation allowed by allow.
+// Cancellation by the caller and errors which did not come from the cache
+// service, such as a full local disk or an entry failing verification, say
+// nothing about the service and are not counted.
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := b.probing
+	b.probing = false
+
+	switch {
+	case err == nil:
+		b.failures = 0
+		if b.open {
+			b.open = false
+			slog.Info("remote cache recovered, using it again")
+		}
+	case errors.Is(err, context.Canceled), !isRemoteError(err):
+	default:
+		b.failures++
+		if b.open {
+			if probe {
+				b.nextProbe = time.Now().Add(b.probeInterval)
+			}
+			return
+		}
+		if b.failures < b.threshold {
+			return
+		}
+
+		b.open = true
+		b.nextProbe = time.Now().Add(b.probeInterval)
+		if !b.warned {
+			b.warned = true
+			slog.Warn(fmt.Sprintf("remote cache failed %d times in a row, continuing with the local cache only", b.failures), "error", err, titleKey, "Remote cache disabled")
+		} else {
+			slog.Debug("remote cache is failing again", "error", err)
+		}
+	}
+}
+
+// isOpen reports whether remote operations are currently skipped.
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.open
+}
+
+// isRemoteError reports whether err came from talking to the cache service:
+// an error status, or a failed, stalled or timed out connection.
+func isRemoteError(err error) bool {
+	var he actionscache.HTTPError
+	var ne net.Error
+	return errors.As(err, &he) ||
+		errors.As(err, &ne) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, errStalled) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	codecNone = ""
+	codecZstd = "zstd"
+
+	defaultCompressionMinSize = 1024
+)
+
+// compression configures how objects are encoded before they are uploaded.
+// A nil *compression disables compression.
+type compression struct {
+	level   zstd.EncoderLevel
+	minSize int64
+	tmpDir  string
+
+	// Byte counters used to report how much compression saved.
+	rawUp, encodedUp     atomic.Int64
+	rawDown, encodedDown atomic.Int64
+}
+
+// parseCompression parses the compression level and minimum object size.
+// An empty level selects the default level; "none" or "off" disables
+// compression.
+func parseCompression(level, minSize, tmpDir string) (*compression, error) {
+	c := &compression{
+		level:   zstd.SpeedDefault,
+		minSize: defaultCompressionMinSize,
+		tmpDir:  tmpDir,
+	}
+
+	switch level {
+	case "":
+	case "none", "off", "false":
+		return nil, nil
+	default:
+		if n, err := strconv.Atoi(level); err == nil {
+			c.level = zstd.EncoderLevelFromZstd(n)
+			break
+		}
+		ok, l := zstd.EncoderLevelFromString(level)
+		if !ok {
+			return nil, fmt.Errorf("unknown compression level %q", level)
+		}
+		c.level = l
+	}
+
+	if minSize != "" {
+		n, err := strconv.ParseInt(minSize, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid compression minimum size %q", minSize)
+		}
+		c.minSize = n
+	}
+
+	return c, nil
+}
+
+// encodedObject is the form of a local object that gets uploaded.
+type encodedObject struct {
+	path  string
+	size  int64 // size of the file at path
+	codec string
+	temp  bool // path is a temporary file which must be removed after use
+}
+
+// encode returns the form of the object at path that should be uploaded.
+// Small objects, and objects which do not get any smaller, are uploaded as-is.
+func (c *compression) encode(path string, size int64) (encodedObject, error) {
+	obj := encodedObject{path: path, size: size, codec: codecNone}
+	if c == nil || size < c.minSize {
+		return obj, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return obj, fmt.Errorf("error opening local cache file: %w", err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(c.tmpDir, "zstd-")
+	if err != nil {
+		return obj, fmt.Errorf("error creating temp file: %w", err)
+	}
+
+	n, err := c.compressTo(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return obj, fmt.Errorf("error compressing object: %w", err)
+	}
+
+	c.rawUp.Add(size)
+	if n >= size {
+		os.Remove(tmp.Name())
+		c.encodedUp.Add(size)
+		return obj, nil
+	}
+	c.encodedUp.Add(n)
+
+	slog.Debug("compressed object", "path", path, "size", size, "compressed", n)
+	return encodedObject{path: tmp.Name(), size: n, codec: codecZstd, temp: true}, nil
+}
+
+func (c *compression) compressTo(w io.Writer, r io.Reader) (int64, error) {
+	cw := &countWriter{w: w}
+	enc, err := zstd.NewWriter(cw, zstd.WithEncoderLevel(c.level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(enc, r); err != nil {
+		enc.Close()
+		return 0, err
+	}
+	if err := enc.Close(); err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+// decode wraps r, which holds an object encoded with codec, to return the
+// original content.
+// The returned function must be called once the content has been read.
+func (c *compression) decode(r io.Reader, codec string, size int64) (io.Reader, func(), error) {
+	switch codec {
+	case codecNone:
+		return r, func() {}, nil
+	case codecZstd:
+		cr := &countReader{r: r}
+		dec, err := zstd.NewReader(cr, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return dec, func() {
+			dec.Close()
+			if c != nil {
+				c.rawDown.Add(size)
+				c.encodedDown.Add(cr.n)
+			}
+			slog.Debug("decompressed object", "size", size, "compressed", cr.n)
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported codec %q", errVerify, codec)
+	}
+}
+
+// logSavings reports the bytes saved through compression during this run.
+func (c *compression) logSavings() {
+	if c == nil {
+		return
+	}
+
+	rawUp, encUp := c.rawUp.Load(), c.encodedUp.Load()
+	rawDown, encDown := c.rawDown.Load(), c.encodedDown.Load()
+	if rawUp == 0 && rawDown == 0 {
+		return
+	}
+
+	slog.Info("compression savings",
+		"uploadBytes", rawUp,
+		"uploadCompressedBytes", encUp,
+		"uploadSavedBytes", rawUp-encUp,
+		"downloadBytes", rawDown,
+		"downloadCompressedBytes", encDown,
+		"downloadSavedBytes", rawDown-encDown,
+	)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
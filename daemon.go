@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// In daemon mode a single long-lived process owns the handler, and with it
+// the key index and the pending uploads, for a whole job. Each go command
+// runs the tool in client mode, which forwards the GOCACHEPROG protocol to the
+// daemon over a unix socket.
+//
+// A connection starts with a single line naming what the client wants:
+// daemonHelloCache followed by the gocache protocol, or daemonHelloFlush to
+// wait for all uploads and stop the daemon. The reply to a flush is
+// daemonReplySummary followed by the run summary as JSON on a line of its
+// own, if there is one to report, and then a line which is either "ok" or
+// "error: <message>". Only the first flush gets the summary.
+const (
+	actionsCacheGoSocket = "ACTIONS_CACHE_GO_SOCKET"
+	defaultSocketName    = "daemon.sock"
+
+	daemonHelloCache   = "gocache"
+	daemonHelloFlush   = "flush"
+	daemonReplySummary = "summary "
+)
+
+// socketPath returns the path of the daemon socket.
+func socketPath(cacheDirPath string) string {
+	if v := os.Getenv(actionsCacheGoSocket); v != "" {
+		return v
+	}
+	return filepath.Join(cacheDirPath, defaultSocketName)
+}
+
+// runDaemon serves cache requests from clients on the daemon socket until a
+// client asks for a flush or ctx is canceled.
+func runDaemon(ctx context.Context, cacheDirPath string) error {
+	path := socketPath(cacheDirPath)
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("daemon is already running on %s", path)
+	}
+	// Remove a socket left behind by a daemon that did not shut down cleanly.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing stale socket: %w", err)
+	}
+
+	h, err := newHandler(ctx, cacheDirPath)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", path, err)
+	}
+	defer os.Remove(path)
+
+	serveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	context.AfterFunc(serveCtx, func() { ln.Close() })
+
+	slog.Info("cache daemon listening", "socket", path)
+
+	var (
+		conns    sync.WaitGroup
+		flushMu  sync.Mutex
+		flushErr error
+		flushed  bool
+	)
+	flush := func() (*runSummary, error) {
+		flushMu.Lock()
+		defer flushMu.Unlock()
+
+		if flushed {
+			return nil, flushErr
+		}
+		flushed = true
+		flushErr = h.Close(ctx)
+		stop()
+
+		if s := h.runSummary(); h.summary && !s.empty() {
+			return &s, flushErr
+		}
+		return nil, flushErr
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if serveCtx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("error accepting connection: %w", err)
+		}
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer conn.Close()
+			if err := h.serveConn(serveCtx, conn, flush); err != nil {
+				slog.Error("error serving daemon client", "error", err)
+			}
+		}()
+	}
+	conns.Wait()
+
+	// Without a flush the pending uploads are abandoned, as in the
+	// standalone mode when the go command is interrupted. The summary is
+	// left for a later flush to report.
+	s, err := flush()
+	if s != nil {
+		h.saveRunSummary(cacheDirPath)
+	}
+	return err
+}
+
+// serveConn handles a single client connection to the daemon.
+func (h *handler) serveConn(ctx context.Context, conn net.Conn, flush func() (*runSummary, error)) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	rd := bufio.NewReader(conn)
+	hello, err := rd.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading client hello: %w", err)
+	}
+
+	switch strings.TrimSpace(hello) {
+	case daemonHelloCache:
+		// The handler is shared with other clients, so uploads are only
+		// waited for on flush.
+		srv := h.newServer(func(context.Context) error { return nil })
+		defer h.metrics.removeServer(srv)
+		return srv.Run(ctx, rd, conn)
+	case daemonHelloFlush:
+		// Flushing outlives the connection so that a client going away does
+		// not abandon the uploads.
+		stop()
+		s, err := flush()
+		reply := "ok"
+		if err != nil {
+			reply = "error: " + strings.ReplaceAll(err.Error(), "\n", " ")
+		}
+		if s != nil {
+			dt, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			reply = daemonReplySummary + string(dt) + "\n" + reply
+		}
+		_, err = fmt.Fprintln(conn, reply)
+		return err
+	default:
+		return fmt.Errorf("unknown client hello %q", hello)
+	}
+}
+
+// runClient forwards the GOCACHEPROG protocol between the go command and the
+// daemon. If the daemon is not running, requests are served in-process
+// instead.
+func runClient(ctx context.Context, cacheDirPath string, in io.Reader, out io.Writer) error {
+	path := socketPath(cacheDirPath)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		slog.Debug("cache daemon is not running, serving requests directly", "socket", path, "error", err)
+		return do(ctx, cacheDirPath, in, out)
+	}
+	defer conn.Close()
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	if _, err := fmt.Fprintln(conn, daemonHelloCache); err != nil {
+		return fmt.Errorf("error sending hello to daemon: %w", err)
+	}
+
+	go func() {
+		io.Copy(conn, in)
+		// Let the daemon know the go command is done.
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+
+	if _, err := io.Copy(out, conn); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("error reading from daemon: %w", err)
+	}
+	return nil
+}
+
+// runFlush asks the daemon to finish all pending uploads and stop, and waits
+// for it to do so. It then writes the summary of the run, adding up the
+// daemon and any go commands which ran without it, to the job summary and
+// outputs of its own step.
+//
+// Without a daemon, only the summary is written; that is an error if there
+// is none either.
+func runFlush(ctx context.Context, cacheDirPath string) error {
+	path := socketPath(cacheDirPath)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		s, serr := takeRunSummaries(cacheDirPath)
+		if serr != nil || s.empty() {
+			return fmt.Errorf("error connecting to cache daemon: %w", err)
+		}
+		s.report()
+		return nil
+	}
+	defer conn.Close()
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	if _, err := fmt.Fprintln(conn, daemonHelloFlush); err != nil {
+		return fmt.Errorf("error sending flush to daemon: %w", err)
+	}
+
+	var s runSummary
+	rd := bufio.NewReader(conn)
+	reply, err := rd.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error waiting for daemon to flush: %w", err)
+	}
+	if dt, ok := strings.CutPrefix(reply, daemonReplySummary); ok {
+		if err := json.Unmarshal([]byte(dt), &s); err != nil {
+			return fmt.Errorf("error reading summary from daemon: %w", err)
+		}
+		if reply, err = rd.ReadString('\n'); err != nil {
+			return fmt.Errorf("error waiting for daemon to flush: %w", err)
+		}
+	}
+
+	if saved, err := takeRunSummaries(cacheDirPath); err != nil {
+		slog.Error("error reading run summaries", "error", err)
+	} else {
+		s.merge(saved)
+	}
+	if !s.empty() {
+		s.report()
+	}
+
+	reply = strings.TrimSpace(reply)
+	if msg, ok := strings.CutPrefix(reply, "error: "); ok {
+		return fmt.Errorf("daemon flush failed: %s", msg)
+	}
+	if reply != "ok" {
+		return fmt.Errorf("unexpected reply from daemon: %q", reply)
+	}
+	return nil
+}
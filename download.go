@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+	"golang.org/x/sync/errgroup"
+)
+
+// Large entries are downloaded in parts, each on its own connection, straight
+// into a temp file. A part that stops making progress is retried from the
+// last byte that was written.
+const (
+	defaultDownloadConcurrency = 4
+	defaultRangedMinSize       = 16 << 20
+	defaultStallTimeout        = 30 * time.Second
+
+	minPartSize         = 4 << 20
+	maxPartAttempts     = 3
+	downloadBufferSize  = 1 << 20
+	downloadTempPattern = "download-"
+)
+
+var errStalled = errors.New("download stalled")
+
+// downloader downloads remote entries, in parallel parts for large ones.
+type downloader struct {
+	// httpClient is used for requests to entry URLs made outside of the
+	// cache client.
+	httpClient *http.Client
+	tmpDir     string
+	// Entries of at least rangedMinSize bytes are downloaded in concurrency
+	// parts at once.
+	concurrency   int
+	rangedMinSize int64
+	stallTimeout  time.Duration
+}
+
+// openEntry returns a reader for a whole remote entry of the given size, which
+// is -1 if it is not known. The returned function releases the reader.
+//
+// If the size is not known, the download is started right away and only
+// switched to parts if the response turns out to be large. Most objects are
+// small, so asking for the size first would add a round trip to nearly every
+// get.
+func (d *downloader) openEntry(ctx context.Context, entry *actionscache.Entry, size int64) (io.Reader, func(), error) {
+	if size >= 0 || d.concurrency < 2 {
+		return d.openRange(ctx, entry, 0, size)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, entry.URL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, nil, actionscache.HTTPError{
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("unexpected status %s for download", resp.Status),
+		}
+	}
+	if resp.ContentLength >= d.rangedMinSize {
+		// Large enough to download in parallel. The response already open
+		// serves the first part.
+		f, err := d.downloadRange(ctx, entry, 0, resp.ContentLength, resp.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return openTemp(f, resp.ContentLength)
+	}
+	return resp.Body, func() { resp.Body.Close() }, nil
+}
+
+// openRange returns a reader for length bytes of entry starting at offset.
+// Ranges of at least the ranged download size are downloaded in parallel
+// into a temp file first. The returned function releases the reader.
+func (d *downloader) openRange(ctx context.Context, entry *actionscache.Entry, offset, length int64) (io.Reader, func(), error) {
+	if length < d.rangedMinSize || d.concurrency < 2 {
+		remote := entry.Download(ctx)
+		if length < 0 {
+			length = math.MaxInt64 - offset
+		}
+		return io.NewSectionReader(remote, offset, length), func() { remote.Close() }, nil
+	}
+
+	f, err := d.downloadRange(ctx, entry, offset, length, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return openTemp(f, length)
+}
+
+// openTemp returns a reader for a downloaded temp file, and a function which
+// closes and removes it.
+func openTemp(f *os.File, length int64) (io.Reader, func(), error) {
+	return io.NewSectionReader(f, 0, length), func() {
+		f.Close()
+		os.Remove(f.Name())
+	}, nil
+}
+
+// downloadRange downloads length bytes of entry starting at offset into a
+// temp file, using several connections at once. If first is not nil, it is
+// a response body positioned at offset, which is used for the first part
+// instead of a new request; downloadRange closes it.
+func (d *downloader) downloadRange(ctx context.Context, entry *actionscache.Entry, offset, length int64, first io.ReadCloser) (_ *os.File, retErr error) {
+	if first != nil {
+		defer first.Close()
+	}
+	f, err := os.CreateTemp(d.tmpDir, downloadTempPattern)
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp file: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Truncate(length); err != nil {
+		return nil, fmt.Errorf("error allocating temp file: %w", err)
+	}
+
+	parts := min(int64(d.concurrency), (length+minPartSize-1)/minPartSize)
+	partSize := (length + parts - 1) / parts
+
+	start := time.Now()
+	eg, ctx := errgroup.WithContext(ctx)
+	for pos := int64(0); pos < length; pos += partSize {
+		end := min(pos+partSize, length)
+		var body io.ReadCloser
+		if pos == 0 {
+			body = first
+		}
+		eg.Go(func() error {
+			return d.downloadPart(ctx, entry, f, offset, pos, end, body)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	slog.Debug("downloaded cache entry", "key", entry.Key, "size", length, "parts", parts, "duration", time.Since(start))
+	return f, nil
+}
+
+// downloadPart downloads the bytes from start to end of the range starting at
+// offset in entry into the same positions of f, retrying from the last byte
+// written when a read fails or stalls. If body is not nil, the first attempt
+// reads from it instead of making a request.
+func (d *downloader) downloadPart(ctx context.Context, entry *actionscache.Entry, f *os.File, offset, start, end int64, body io.ReadCloser) error {
+	pos := start
+	for attempt := 1; ; attempt++ {
+		n, err := d.readPart(ctx, entry, f, offset, pos, end, body)
+		body = nil
+		pos += n
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= maxPartAttempts {
+			return fmt.Errorf("error downloading %q at offset %d: %w", entry.Key, offset+pos, err)
+		}
+		slog.Debug("retrying download", "key", entry.Key, "offset", offset+pos, "attempt", attempt, "error", err)
+	}
+}
+
+// readPart makes a single attempt at downloading a part, and returns the
+// number of bytes written. If body is not nil, the part is read from it;
+// readPart does not close it.
+//
+// The part is requested directly rather than through Entry.Download, which
+// can only read sequentially from the start of the entry without reopening
+// the connection for every read.
+func (d *downloader) readPart(ctx context.Context, entry *actionscache.Entry, f *os.File, offset, pos, end int64, body io.ReadCloser) (int64, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	stall := time.AfterFunc(d.stallTimeout, func() { cancel(errStalled) })
+	defer stall.Stop()
+
+	if body != nil {
+		// The body belongs to a request made with another context, so a
+		// stall has to interrupt the read by closing it.
+		stop := context.AfterFunc(ctx, func() { body.Close() })
+		defer stop()
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, entry.URL, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset+pos, offset+end-1))
+
+		resp, err := d.httpClient.Do(req)
+		if err != nil {
+			if cause := context.Cause(ctx); cause != nil {
+				err = cause
+			}
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			return 0, actionscache.HTTPError{
+				StatusCode: resp.StatusCode,
+				Err:        fmt.Errorf("unexpected status %s for ranged download", resp.Status),
+			}
+		}
+		body = resp.Body
+	}
+
+	buf := make([]byte, downloadBufferSize)
+	var written int64
+	for pos+written < end {
+		chunk := buf[:min(int64(len(buf)), end-pos-written)]
+		n, err := body.Read(chunk)
+		if n > 0 {
+			if _, err := f.WriteAt(chunk[:n], pos+written); err != nil {
+				return written, err
+			}
+			written += int64(n)
+			stall.Reset(d.stallTimeout)
+		}
+		if err != nil {
+			if err == io.EOF && pos+written == end {
+				break
+			}
+			if cause := context.Cause(ctx); cause != nil {
+				err = cause
+			} else if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/creachadair/gocache"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// Every object saved to the remote cache is wrapped in a framed header (see
+// encodeFrame) which records the Go output ID and size of the object, and the
+// codec the body is encoded with. The body follows the header.
+const (
+	entryMagic   = "acgoentr"
+	entryVersion = 1
+
+	// objectKeyPrefix follows the prefix in the key of every object. It
+	// changes with entryVersion, so that entries written in a format this
+	// version cannot read are never mistaken for existing ones. Nothing
+	// restores them any more, so they age out of the cache.
+	objectKeyPrefix = "v1-"
+)
+
+// errVerify is returned when remote content does not match what it claims to
+// be.
+var errVerify = errors.New("cache entry failed verification")
+
+type entryHeader struct {
+	OutputID string `json:"output_id"`
+	Size     int64  `json:"size"`
+	// Codec is the encoding of the body. Entries without a codec are stored
+	// uncompressed.
+	Codec string `json:"codec,omitempty"`
+}
+
+func encodeEntryHeader(hdr entryHeader) ([]byte, error) {
+	return encodeFrame(entryMagic, entryVersion, hdr)
+}
+
+func readEntryHeader(r io.Reader) (entryHeader, error) {
+	var hdr entryHeader
+
+	version, _, err := readFrame(r, entryMagic, &hdr)
+	if err != nil {
+		if errors.Is(err, errNoFrame) {
+			// Written by an older version of this tool which did not record
+			// the output ID, so there is no way to use it.
+			return hdr, fmt.Errorf("%w: unversioned entry", errVerify)
+		}
+		return hdr, err
+	}
+	if version != entryVersion {
+		return hdr, fmt.Errorf("unsupported entry version %d", version)
+	}
+	if err := checkOutputID(hdr.OutputID); err != nil {
+		return hdr, err
+	}
+	if hdr.Size < 0 {
+		return hdr, fmt.Errorf("%w: invalid size %d", errVerify, hdr.Size)
+	}
+	return hdr, nil
+}
+
+// objectKey returns the remote cache key for a Go action ID.
+func (h *handler) objectKey(actionID string) string {
+	return h.prefix + objectKeyPrefix + actionID
+}
+
+// checkOutputID makes sure id looks like a Go output ID.
+// The ID is used to build a path in the local cache so it must not be trusted
+// blindly.
+func checkOutputID(id string) error {
+	if len(id) != sha256.Size*2 {
+		return fmt.Errorf("%w: invalid output ID %q", errVerify, id)
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return fmt.Errorf("%w: invalid output ID %q", errVerify, id)
+	}
+	return nil
+}
+
+// verifyReader checks that the content read through it hashes to the expected
+// output ID and has the expected size.
+// The go command computes output IDs as the SHA-256 of the object content.
+type verifyReader struct {
+	r        io.Reader
+	h        hash.Hash
+	n        int64
+	size     int64
+	outputID string
+}
+
+func newVerifyReader(r io.Reader, outputID string, size int64) *verifyReader {
+	return &verifyReader{
+		r:        r,
+		h:        sha256.New(),
+		size:     size,
+		outputID: outputID,
+	}
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+
+	if v.n > v.size {
+		return n, fmt.Errorf("%w: expected %d bytes, got more", errVerify, v.size)
+	}
+
+	if err == io.EOF {
+		if v.n != v.size {
+			return n, fmt.Errorf("%w: expected %d bytes, got %d", errVerify, v.size, v.n)
+		}
+		if sum := hex.EncodeToString(v.h.Sum(nil)); sum != v.outputID {
+			return n, fmt.Errorf("%w: content hash %s does not match output ID", errVerify, sum)
+		}
+	}
+	return n, err
+}
+
+// newEntryBlob encodes the local object at path and wraps it in an entry
+// header for upload.
+func (h *handler) newEntryBlob(path, outputID string, size int64) (*concatBlob, error) {
+	obj, err := h.compression.encode(path, size)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := encodeEntryHeader(entryHeader{OutputID: outputID, Size: size, Codec: obj.codec})
+	if err != nil {
+		if obj.temp {
+			os.Remove(obj.path)
+		}
+		return nil, fmt.Errorf("error encoding entry header: %w", err)
+	}
+
+	blob := newConcatBlob(header)
+	if err := blob.addObject(obj); err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return blob, nil
+}
+
+// getEntry downloads a remote entry into the local cache.
+// Entries that fail verification are reported and treated as a cache miss.
+func (h *handler) getEntry(ctx context.Context, actionID string, entry *actionscache.Entry) (*getRet, error) {
+	size, ok := h.index.size(entry.Key)
+	if !ok {
+		size = -1
+	}
+
+	start := time.Now()
+	remote, release, err := h.downloads.openEntry(ctx, entry, size)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading cache entry %q: %w", actionID, err)
+	}
+	defer release()
+	rdr := &countReader{r: remote}
+
+	hdr, err := readEntryHeader(rdr)
+	if err != nil {
+		if errors.Is(err, errVerify) {
+			slog.Warn("ignoring remote cache entry", "actionID", actionID, "error", err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading cache entry %q: %w", actionID, err)
+	}
+
+	body, done, err := h.compression.decode(rdr, hdr.Codec, hdr.Size)
+	if err != nil {
+		if errors.Is(err, errVerify) {
+			slog.Warn("ignoring remote cache entry", "actionID", actionID, "error", err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading cache entry %q: %w", actionID, err)
+	}
+
+	p, err := h.local.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: hdr.OutputID,
+		Size:     hdr.Size,
+		Body:     newVerifyReader(body, hdr.OutputID, hdr.Size),
+	})
+	done()
+	if err != nil {
+		if errors.Is(err, errVerify) {
+			slog.Warn("ignoring remote cache entry", "actionID", actionID, "error", err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error storing in local cache: %w", err)
+	}
+	h.metrics.downloadBytes.Add(rdr.n)
+	h.metrics.observe(h.metrics.download, "download", actionID, start)
+	return &getRet{outputID: hdr.OutputID, diskPath: p, remote: true}, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envBool returns the boolean value of the environment variable name, or def
+// if it is not set.
+func envBool(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %q", name, v)
+	}
+	return b, nil
+}
+
+// envInt returns the value of the environment variable name as a positive
+// integer, or def if it is not set.
+func envInt(name string, def int64) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q", name, v)
+	}
+	return n, nil
+}
+
+// envFraction returns the value of the environment variable name as a number
+// between 0 and 1, or def if it is not set.
+// Percentages such as "80%" are accepted as well.
+func envFraction(name string, def float64) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	s, percent := strings.CutSuffix(v, "%")
+	f, err := strconv.ParseFloat(s, 64)
+	if percent {
+		f /= 100
+	}
+	if err != nil || f <= 0 || f > 1 {
+		return 0, fmt.Errorf("invalid value for %s: %q", name, v)
+	}
+	return f, nil
+}
+
+// envDuration returns the value of the environment variable name as a
+// duration, or def if it is not set.
+// Plain numbers are interpreted as seconds.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q", name, v)
+	}
+	return d, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// keyFilter selects remote cache entries for the commands which work on the
+// remote cache directly, such as prune and list.
+// Zero fields match every entry.
+type keyFilter struct {
+	prefix string
+	// ref is either an exact ref or a pattern as understood by path.Match,
+	// e.g. refs/pull/*/merge.
+	ref            string
+	accessedBefore timeFlag
+	createdBefore  timeFlag
+	minSize        int64
+}
+
+// register adds flags for the filter to fs.
+func (f *keyFilter) register(fs *flag.FlagSet) {
+	prefix := defaultActionsCacheGoPrefix
+	if v, ok := os.LookupEnv(actionsCacheGoPrefix); ok {
+		prefix = v
+	}
+	fs.StringVar(&f.prefix, "prefix", prefix, "only entries with keys starting with `prefix`")
+	fs.StringVar(&f.ref, "ref", "", "only entries for refs matching `pattern`, e.g. refs/pull/*/merge")
+	fs.Var(&f.accessedBefore, "accessed-before", "only entries last accessed before `time`, either a date or an age such as 72h or 7d")
+	fs.Var(&f.createdBefore, "created-before", "only entries created before `time`, either a date or an age such as 72h or 7d")
+	fs.Int64Var(&f.minSize, "min-size", 0, "only entries of at least `bytes`")
+}
+
+// match reports whether k is selected by the filter.
+// Entries with timestamps which cannot be parsed never match a time filter.
+func (f *keyFilter) match(k actionscache.CacheKey) bool {
+	if !strings.HasPrefix(k.Key, f.prefix) {
+		return false
+	}
+	if f.ref != "" {
+		if ok, _ := path.Match(f.ref, k.Ref); !ok {
+			return false
+		}
+	}
+	if !f.accessedBefore.IsZero() && !before(k.LastAccessed, f.accessedBefore.Time) {
+		return false
+	}
+	if !f.createdBefore.IsZero() && !before(k.CreatedAt, f.createdBefore.Time) {
+		return false
+	}
+	return int64(k.SizeInBytes) >= f.minSize
+}
+
+// list returns every entry in the remote cache selected by the filter.
+func (f *keyFilter) list(ctx context.Context, api *RestAPI) ([]actionscache.CacheKey, error) {
+	// The API filters by exact ref, patterns are matched here.
+	var ref string
+	if !strings.ContainsAny(f.ref, `*?[\`) {
+		ref = f.ref
+	}
+
+	var keys []actionscache.CacheKey
+	for page, err := range api.ListKeys(ctx, f.prefix, ref) {
+		if err != nil {
+			return nil, fmt.Errorf("error listing keys: %w", err)
+		}
+		for _, k := range page {
+			if f.match(k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// before reports whether the API timestamp ts is before t.
+func before(ts string, t time.Time) bool {
+	v, err := time.Parse(time.RFC3339, ts)
+	return err == nil && v.Before(t)
+}
+
+// timeFlag is a flag.Value for a point in time, given either as a date or
+// time, or as an age relative to now.
+type timeFlag struct {
+	time.Time
+	s string
+}
+
+func (t *timeFlag) String() string { return t.s }
+
+func (t *timeFlag) Set(s string) error {
+	v, err := parseTime(s, time.Now())
+	if err != nil {
+		return err
+	}
+	t.Time, t.s = v, s
+	return nil
+}
+
+// parseTime parses s as an RFC 3339 time, a date, or an age such as 72h or
+// 7d, which is subtracted from now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// newCommandRestAPI creates a REST API client for the repository named by
+// repo, or GITHUB_REPOSITORY if it is empty.
+func newCommandRestAPI(repo string) (*RestAPI, error) {
+	if repo == "" {
+		repo = os.Getenv(githubRepo)
+	}
+	if repo == "" {
+		return nil, fmt.Errorf("missing repository, set %s or use -repo", githubRepo)
+	}
+	token := os.Getenv(restAPIToken)
+	if token == "" {
+		return nil, fmt.Errorf("missing %s environment variable", restAPIToken)
+	}
+	return newRestAPIFromEnv(repo, token, http.DefaultClient)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Packs and cache entries both start with a small framed header:
+//
+//	magic (8 bytes) | version (uint32) | header length (uint32) | header (JSON)
+//
+// The data described by the header follows immediately after it.
+
+// maxFrameSize protects against reading garbage as a header length.
+const maxFrameSize = 64 << 20
+
+func encodeFrame(magic string, version uint32, v any) ([]byte, error) {
+	dt, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(magic) + 8 + len(dt))
+	buf.WriteString(magic)
+	binary.Write(&buf, binary.BigEndian, version)
+	binary.Write(&buf, binary.BigEndian, uint32(len(dt)))
+	buf.Write(dt)
+	return buf.Bytes(), nil
+}
+
+// errNoFrame is returned by readFrame when the data does not start with the
+// expected magic.
+var errNoFrame = errors.New("missing header")
+
+// readFrame decodes a framed header from r into v.
+// It returns the version of the frame and the number of bytes consumed.
+func readFrame(r io.Reader, magic string, v any) (uint32, int64, error) {
+	hdr := make([]byte, len(magic)+8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, 0, errNoFrame
+		}
+		return 0, 0, err
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return 0, 0, errNoFrame
+	}
+
+	version := binary.BigEndian.Uint32(hdr[len(magic):])
+
+	n := binary.BigEndian.Uint32(hdr[len(magic)+4:])
+	if n > maxFrameSize {
+		return 0, 0, fmt.Errorf("header too large: %d bytes", n)
+	}
+
+	dt := make([]byte, n)
+	if _, err := io.ReadFull(r, dt); err != nil {
+		return 0, 0, fmt.Errorf("error reading header: %w", err)
+	}
+
+	if err := json.Unmarshal(dt, v); err != nil {
+		return 0, 0, fmt.Errorf("error decoding header: %w", err)
+	}
+	return version, int64(len(hdr)) + int64(n), nil
+}
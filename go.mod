@@ -3,7 +3,9 @@ module github.com/cpuguy83/actions-cache-go
 go 1.23.2
 
 require (
+	github.com/creachadair/atomicfile v0.3.7
 	github.com/creachadair/gocache v0.0.0-20250308180106-a796ff41ea7b
+	github.com/klauspost/compress v1.18.0
 	github.com/pkg/errors v0.9.1
 	github.com/tonistiigi/go-actions-cache v0.0.0-20250228231703-3e9a6642607f
 	golang.org/x/sync v0.12.0
@@ -13,7 +15,6 @@ require (
 	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.17.0 // indirect
 	github.com/Azure/azure-sdk-for-go/sdk/internal v1.10.0 // indirect
 	github.com/Azure/azure-sdk-for-go/sdk/storage/azblob v1.6.0 // indirect
-	github.com/creachadair/atomicfile v0.3.7 // indirect
 	github.com/creachadair/mds v0.24.0 // indirect
 	github.com/creachadair/taskgroup v0.13.2 // indirect
 	github.com/dimchansky/utfbom v1.1.1 // indirect
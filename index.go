@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"sync"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// keyIndex tracks which keys exist in the remote cache.
+// It is filled in the background while keys are listed so that lookups for
+// keys which have already been seen do not have to wait for the full listing.
+type keyIndex struct {
+	mu    sync.Mutex
+	keys  map[string]actionscache.CacheKey
+	packs map[string]packRef
+	// removed holds keys which were found to no longer exist.
+	removed map[string]struct{}
+
+	// updated is closed and replaced whenever the index changes.
+	updated chan struct{}
+	done    bool
+	// complete is set when the index is known to contain every key, so a
+	// key that is not in the index does not exist.
+	complete bool
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		keys:    make(map[string]actionscache.CacheKey),
+		packs:   make(map[string]packRef),
+		removed: make(map[string]struct{}),
+		updated: make(chan struct{}),
+	}
+}
+
+// notify wakes up anyone waiting for changes. The caller must hold x.mu.
+func (x *keyIndex) notify() {
+	close(x.updated)
+	x.updated = make(chan struct{})
+}
+
+func (x *keyIndex) addKeys(keys []actionscache.CacheKey) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, k := range keys {
+		x.keys[k.Key] = k
+	}
+	x.notify()
+}
+
+func (x *keyIndex) addPacks(refs map[string]packRef) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for k, ref := range refs {
+		x.packs[k] = ref
+	}
+	x.notify()
+}
+
+// remove drops a key which turned out not to exist, e.g. because it was
+// evicted after the index was built.
+func (x *keyIndex) remove(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.keys, key)
+	x.removed[key] = struct{}{}
+
+	// If key is a pack, its members went with it.
+	for k, ref := range x.packs {
+		if ref.entry.Key == key {
+			delete(x.packs, k)
+		}
+	}
+}
+
+// snapshot returns the keys currently in the index, along with the keys that
+// were removed from it.
+func (x *keyIndex) snapshot() ([]actionscache.CacheKey, map[string]struct{}) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	keys := make([]actionscache.CacheKey, 0, len(x.keys))
+	for _, k := range x.keys {
+		keys = append(keys, k)
+	}
+	return keys, maps.Clone(x.removed)
+}
+
+// size returns the size of key if it is in the index.
+func (x *keyIndex) size(key string) (int64, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	k, ok := x.keys[key]
+	if !ok || k.SizeInBytes <= 0 {
+		return 0, false
+	}
+	return int64(k.SizeInBytes), true
+}
+
+// packRefs returns the location of every key stored in a pack.
+func (x *keyIndex) packRefs() map[string]packRef {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return maps.Clone(x.packs)
+}
+
+// finish marks the index as fully loaded. complete should be false if some
+// keys may be missing from the index, e.g. because listing them failed.
+func (x *keyIndex) finish(complete bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.done = true
+	x.complete = complete
+	x.notify()
+}
+
+// wait waits for the index to be fully loaded and reports whether it is
+// complete.
+func (x *keyIndex) wait(ctx context.Context) bool {
+	for {
+		x.mu.Lock()
+		done, complete, updated := x.done, x.complete, x.updated
+		x.mu.Unlock()
+
+		if done {
+			return complete
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-updated:
+		}
+	}
+}
+
+// lookup reports whether key is in the index, either as its own entry or as a
+// member of a pack. If the key is in a pack, its location is returned.
+// complete reports whether the index is complete, i.e. whether a key which was
+// not found can be trusted not to exist.
+//
+// If the key has not been seen yet, lookup waits until it shows up or the
+// index is fully loaded.
+func (x *keyIndex) lookup(ctx context.Context, key string) (ref *packRef, found, complete bool) {
+	for {
+		x.mu.Lock()
+		if ref, ok := x.packs[key]; ok {
+			x.mu.Unlock()
+			return &ref, true, true
+		}
+		if _, ok := x.keys[key]; ok {
+			x.mu.Unlock()
+			return nil, true, true
+		}
+		if x.done {
+			complete := x.complete
+			x.mu.Unlock()
+			return nil, false, complete
+		}
+		updated := x.updated
+		x.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, false, false
+		case <-updated:
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/creachadair/atomicfile"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+	"golang.org/x/sync/errgroup"
+)
+
+// inspectResult describes a single object in the remote cache.
+type inspectResult struct {
+	Key string `json:"key"`
+	// Pack is the key of the pack holding the object, if it is packed.
+	Pack  string `json:"pack,omitempty"`
+	Scope string `json:"scope,omitempty"`
+
+	// These describe the cache entry, i.e. the pack for packed objects, and
+	// are only known with a REST API token.
+	Ref          string `json:"ref,omitempty"`
+	Version      string `json:"version,omitempty"`
+	EntrySize    int64  `json:"entry_size,omitempty"`
+	CreatedAt    string `json:"created_at,omitempty"`
+	LastAccessed string `json:"last_accessed_at,omitempty"`
+
+	OutputID string `json:"output_id"`
+	Size     int64  `json:"size"`
+	Codec    string `json:"codec,omitempty"`
+}
+
+// runInspect implements the inspect command, which prints what the remote
+// cache holds for a single action ID and optionally saves the object.
+func runInspect(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	prefix := defaultActionsCacheGoPrefix
+	if v, ok := os.LookupEnv(actionsCacheGoPrefix); ok {
+		prefix = v
+	}
+	fs.StringVar(&prefix, "prefix", prefix, "`prefix` of the cache keys")
+	repo := fs.String("repo", "", "`owner/name` of the repository (default $GITHUB_REPOSITORY)")
+	output := fs.String("o", "", "save the object to `file`")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: actions-cache-go inspect [flags] <actionID>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a single action ID")
+	}
+
+	url, isV2 := cacheServiceURL()
+	if url == "" {
+		return fmt.Errorf("missing %q or %q environment variable", actionsCacheURL, actionsResultURL)
+	}
+	client, err := actionscache.New(os.Getenv(actionsToken), url, isV2, actionscache.Opt{})
+	if err != nil {
+		return fmt.Errorf("error creating cache client: %w", err)
+	}
+
+	// The REST API is only needed to find packed objects and to describe the
+	// entry, so it is optional.
+	var api *RestAPI
+	if os.Getenv(restAPIToken) != "" {
+		api, err = newCommandRestAPI(*repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	in := &inspector{
+		client:  client,
+		restAPI: api,
+		prefix:  prefix,
+		downloads: &downloader{
+			httpClient:    http.DefaultClient,
+			tmpDir:        os.TempDir(),
+			concurrency:   defaultDownloadConcurrency,
+			rangedMinSize: defaultRangedMinSize,
+			stallTimeout:  defaultStallTimeout,
+		},
+	}
+
+	key := fs.Arg(0)
+	if !strings.HasPrefix(key, prefix) {
+		key = prefix + objectKeyPrefix + key
+	}
+
+	res, body, release, err := in.inspect(ctx, key, *output != "")
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		defer release()
+		_, err := atomicfile.WriteAll(*output, newVerifyReader(body, res.OutputID, res.Size), 0644)
+		if err != nil {
+			return fmt.Errorf("error saving object: %w", err)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	return writeInspectResult(out, res)
+}
+
+// inspector looks up single objects in the remote cache.
+type inspector struct {
+	client *actionscache.Cache
+	// restAPI is nil without a token, in which case packed objects cannot be
+	// found.
+	restAPI   *RestAPI
+	prefix    string
+	downloads *downloader
+	// compression is only used to decode objects, so it is left nil.
+	compression *compression
+}
+
+// inspect looks up key in the remote cache, on its own or in a pack. If
+// withBody is set, it also returns a reader for the decoded object, which must
+// be released by calling the returned function.
+func (in *inspector) inspect(ctx context.Context, key string, withBody bool) (res inspectResult, _ io.Reader, _ func(), _ error) {
+	res.Key = key
+
+	entry, err := in.client.Load(ctx, key)
+	if err != nil {
+		return res, nil, nil, fmt.Errorf("error loading cache key %q: %w", key, err)
+	}
+
+	var (
+		codec   string
+		body    io.Reader
+		release func()
+	)
+	if entry != nil && entry.Key == key {
+		res.Scope = entry.Scope
+
+		rdr, done, err := in.downloads.openEntry(ctx, entry, -1)
+		if err != nil {
+			return res, nil, nil, fmt.Errorf("error downloading cache entry %q: %w", key, err)
+		}
+		hdr, err := readEntryHeader(rdr)
+		if err != nil {
+			done()
+			return res, nil, nil, fmt.Errorf("error reading cache entry %q: %w", key, err)
+		}
+		res.OutputID, res.Size, res.Codec = hdr.OutputID, hdr.Size, hdr.Codec
+
+		codec, body, release = hdr.Codec, rdr, done
+		if !withBody {
+			done()
+			body = nil
+		}
+	} else {
+		ref, err := in.findPacked(ctx, key)
+		if err != nil {
+			return res, nil, nil, err
+		}
+		res.Pack, res.Scope = ref.entry.Key, ref.entry.Scope
+		res.OutputID, res.Size, res.Codec = ref.outputID, ref.size, ref.codec
+
+		if withBody {
+			codec = ref.codec
+			body, release, err = in.downloads.openRange(ctx, ref.entry, ref.offset, ref.length)
+			if err != nil {
+				return res, nil, nil, fmt.Errorf("error downloading pack %q: %w", ref.entry.Key, err)
+			}
+		}
+	}
+
+	if in.restAPI != nil {
+		entryKey := cmp.Or(res.Pack, key)
+		for page, err := range in.restAPI.ListKeys(ctx, entryKey, "") {
+			if err != nil {
+				if release != nil {
+					release()
+				}
+				return res, nil, nil, fmt.Errorf("error listing keys: %w", err)
+			}
+			for _, k := range page {
+				if k.Key != entryKey || (res.Ref != "" && k.Ref != res.Scope) {
+					continue
+				}
+				res.Ref, res.Version, res.EntrySize = k.Ref, k.Version, int64(k.SizeInBytes)
+				res.CreatedAt, res.LastAccessed = k.CreatedAt, k.LastAccessed
+			}
+		}
+	}
+
+	if body == nil {
+		return res, nil, nil, nil
+	}
+	dec, done, err := in.compression.decode(body, codec, res.Size)
+	if err != nil {
+		release()
+		return res, nil, nil, err
+	}
+	return res, dec, func() {
+		done()
+		release()
+	}, nil
+}
+
+// findPacked looks for key in every pack under the prefix.
+func (in *inspector) findPacked(ctx context.Context, key string) (packRef, error) {
+	if in.restAPI == nil {
+		return packRef{}, fmt.Errorf("cache key %q not found, set %s to look for it in packs", key, restAPIToken)
+	}
+
+	var (
+		mu    sync.Mutex
+		found *packRef
+	)
+	var packs errgroup.Group
+	packs.SetLimit(packIndexLoadConcurrency)
+	for page, err := range in.restAPI.ListKeys(ctx, in.prefix+packKeyPrefix, "") {
+		if err != nil {
+			return packRef{}, fmt.Errorf("error listing packs: %w", err)
+		}
+		for _, k := range page {
+			packs.Go(func() error {
+				refs, err := readPackRefs(ctx, in.client, in.prefix, k.Key)
+				if err != nil {
+					slog.Error("error loading pack", "key", k.Key, "error", err)
+					return nil
+				}
+				if ref, ok := refs[key]; ok {
+					mu.Lock()
+					found = &ref
+					mu.Unlock()
+				}
+				return nil
+			})
+		}
+	}
+	packs.Wait()
+
+	if found == nil {
+		return packRef{}, fmt.Errorf("cache key %q not found", key)
+	}
+	return *found, nil
+}
+
+func writeInspectResult(out io.Writer, res inspectResult) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", name, value)
+		}
+	}
+	field("key", res.Key)
+	field("pack", res.Pack)
+	field("scope", res.Scope)
+	field("ref", res.Ref)
+	field("version", res.Version)
+	if res.EntrySize > 0 {
+		field("entry size", formatBytes(res.EntrySize))
+	}
+	field("created", res.CreatedAt)
+	field("last accessed", res.LastAccessed)
+	field("output ID", res.OutputID)
+	field("size", fmt.Sprintf("%s (%d bytes)", formatBytes(res.Size), res.Size))
+	field("codec", cmp.Or(res.Codec, "none"))
+	return tw.Flush()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+)
+
+// The journal records objects that were put but not yet uploaded, so that
+// uploads lost when the process is killed, or abandoned when Close runs out
+// of time, are retried by the next run.
+//
+// Each pending upload is a small JSON file in the journal directory, named
+// after the hash of its action ID. The file is written when the object is put
+// and removed once the object is in the remote cache. Writes happen in the
+// background so puts do not wait for the disk; close flushes them.
+const (
+	journalDirName = "journal"
+	// maxJournalAttempts is the number of runs that try to upload a journaled
+	// object before giving up on it.
+	maxJournalAttempts = 3
+
+	defaultDrainTimeout = 10 * time.Minute
+)
+
+type journalEntry struct {
+	ActionID string `json:"action_id"`
+	OutputID string `json:"output_id"`
+	Size     int64  `json:"size"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+type journal struct {
+	dir string
+
+	mu sync.Mutex
+	// pending holds the changes not written yet, by action ID. A nil entry
+	// removes the file.
+	pending map[string]*journalEntry
+	wake    chan struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+func newJournal(cacheDirPath string) (*journal, error) {
+	dir := filepath.Join(cacheDirPath, journalDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating journal directory: %w", err)
+	}
+	j := &journal{
+		dir:     dir,
+		pending: map[string]*journalEntry{},
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go j.run()
+	return j, nil
+}
+
+func (j *journal) path(actionID string) string {
+	sum := sha256.Sum256([]byte(actionID))
+	return filepath.Join(j.dir, hex.EncodeToString(sum[:16]))
+}
+
+// add records a pending upload.
+func (j *journal) add(e journalEntry) {
+	j.set(e.ActionID, &e)
+}
+
+// remove drops a pending upload once it is no longer needed.
+func (j *journal) remove(actionID string) {
+	j.set(actionID, nil)
+}
+
+// set queues a change for the writer. Only the latest change to an action ID
+// is written. After close, changes are written directly.
+func (j *journal) set(actionID string, e *journalEntry) {
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		j.write(actionID, e)
+		return
+	}
+	j.pending[actionID] = e
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+	j.mu.Unlock()
+}
+
+func (j *journal) run() {
+	defer close(j.done)
+	for range j.wake {
+		j.flush()
+	}
+	j.flush()
+}
+
+// flush writes out the pending changes.
+func (j *journal) flush() {
+	j.mu.Lock()
+	pending := j.pending
+	j.pending = map[string]*journalEntry{}
+	j.mu.Unlock()
+
+	for actionID, e := range pending {
+		j.write(actionID, e)
+	}
+}
+
+func (j *journal) write(actionID string, e *journalEntry) {
+	if e == nil {
+		if err := os.Remove(j.path(actionID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Debug("error removing upload journal entry", "actionID", actionID, "error", err)
+		}
+		return
+	}
+	dt, err := json.Marshal(e)
+	if err == nil {
+		err = atomicfile.WriteData(j.path(actionID), dt, 0644)
+	}
+	if err != nil {
+		slog.Debug("error writing upload journal", "actionID", actionID, "error", err)
+	}
+}
+
+// close writes out the pending changes and stops the writer.
+// It is safe to call more than once.
+func (j *journal) close() {
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		return
+	}
+	j.closed = true
+	close(j.wake)
+	j.mu.Unlock()
+
+	<-j.done
+}
+
+// entries returns every pending upload in the journal.
+func (j *journal) entries() ([]journalEntry, error) {
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []journalEntry
+	for _, f := range files {
+		if !f.Type().IsRegular() {
+			continue
+		}
+		p := filepath.Join(j.dir, f.Name())
+		dt, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var e journalEntry
+		if err := json.Unmarshal(dt, &e); err != nil || e.ActionID == "" {
+			// Not one of ours, or a leftover temp file.
+			os.Remove(p)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// resumeUploads schedules the uploads left in the journal by previous runs,
+// for objects that are still in the local cache.
+func (h *handler) resumeUploads(ctx context.Context) {
+	entries, err := h.journal.entries()
+	if err != nil {
+		slog.Debug("error reading upload journal", "error", err)
+		return
+	}
+
+	var resumed int
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if !strings.HasPrefix(e.ActionID, h.objectKey("")) {
+			// Journaled by a version which used another key format.
+			h.journal.remove(e.ActionID)
+			continue
+		}
+
+		outputID, path, err := h.local.Get(ctx, e.ActionID)
+		if err != nil || outputID != e.OutputID {
+			// The object was evicted or replaced locally.
+			h.journal.remove(e.ActionID)
+			continue
+		}
+		if e.Attempts >= maxJournalAttempts {
+			slog.Debug("giving up on journaled upload", "actionID", e.ActionID, "attempts", e.Attempts)
+			h.journal.remove(e.ActionID)
+			continue
+		}
+
+		e.Attempts++
+		h.journal.add(e)
+		h.scheduleUpload(&uploadTask{
+			actionID: e.ActionID,
+			outputID: e.OutputID,
+			size:     e.Size,
+			path:     path,
+		})
+		resumed++
+	}
+
+	if resumed > 0 {
+		slog.Info(fmt.Sprintf("resuming %d uploads from a previous run", resumed))
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The adaptive get budget is a multiple of the 90th percentile of recent
+	// remote gets, within these bounds. Until there are enough samples the
+	// maximum is used.
+	minGetBudget        = 2 * time.Second
+	maxGetBudget        = 30 * time.Second
+	getBudgetMultiplier = 3
+	getBudgetMinSamples = 16
+	// The budget is recomputed after this many new samples, rather than on
+	// every get.
+	getBudgetInterval = 16
+
+	latencySamples = 512
+)
+
+// latencyTracker keeps the durations of recent remote gets and derives the
+// time budget for a single get from them.
+type latencyTracker struct {
+	// fixed is the budget to use when it is not adaptive. Zero means gets
+	// have no budget.
+	fixed    time.Duration
+	adaptive bool
+
+	mu      sync.Mutex
+	samples []time.Duration // ring buffer
+	next    int
+	// recorded counts the samples since the budget was last computed.
+	recorded int
+
+	// current is the adaptive budget, zero until there are enough samples.
+	current atomic.Int64
+
+	// expired counts gets that were reported as misses because they ran
+	// out of time.
+	expired atomic.Int64
+}
+
+func newLatencyTracker(budget time.Duration, adaptive bool) *latencyTracker {
+	return &latencyTracker{
+		fixed:    budget,
+		adaptive: adaptive,
+		samples:  make([]time.Duration, 0, latencySamples),
+	}
+}
+
+// record adds the duration of a remote get that completed.
+func (l *latencyTracker) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+	} else {
+		l.samples[l.next] = d
+		l.next = (l.next + 1) % latencySamples
+	}
+
+	l.recorded++
+	if !l.adaptive || len(l.samples) < getBudgetMinSamples || l.recorded < getBudgetInterval && l.current.Load() != 0 {
+		return
+	}
+	l.recorded = 0
+	p90 := percentilesOf(slices.Clone(l.samples), 90)[0]
+	l.current.Store(int64(min(max(p90*getBudgetMultiplier, minGetBudget), maxGetBudget)))
+}
+
+// percentiles returns the given percentiles (0-100) of the recorded
+// durations, and the number of samples they are based on.
+func (l *latencyTracker) percentiles(ps ...float64) ([]time.Duration, int) {
+	l.mu.Lock()
+	samples := slices.Clone(l.samples)
+	l.mu.Unlock()
+
+	return percentilesOf(samples, ps...), len(samples)
+}
+
+// percentilesOf returns the given percentiles (0-100) of samples, which it
+// sorts in place.
+func percentilesOf(samples []time.Duration, ps ...float64) []time.Duration {
+	out := make([]time.Duration, len(ps))
+	if len(samples) == 0 {
+		return out
+	}
+	slices.Sort(samples)
+	for i, p := range ps {
+		idx := int(p / 100 * float64(len(samples)-1))
+		out[i] = samples[idx]
+	}
+	return out
+}
+
+// budget returns how long a get may wait for the remote cache before it is
+// reported as a miss. Zero means there is no limit.
+func (l *latencyTracker) budget() time.Duration {
+	if !l.adaptive {
+		return l.fixed
+	}
+
+	if b := time.Duration(l.current.Load()); b != 0 {
+		return b
+	}
+	return maxGetBudget
+}
+
+// logSummary reports the remote get latencies seen during this run.
+func (l *latencyTracker) logSummary() {
+	p, n := l.percentiles(50, 90, 99)
+	if n == 0 {
+		return
+	}
+
+	slog.Info("remote get latency",
+		"samples", n,
+		"p50", p[0],
+		"p90", p[1],
+		"p99", p[2],
+		"budget", l.budget(),
+		"expired", l.expired.Load(),
+	)
+}
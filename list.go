@@ -0,0 +1,106 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// runList implements the list command, which prints the entries in the
+// remote cache selected by the filter flags, most recently used first.
+func runList(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	var filter keyFilter
+	filter.register(fs)
+	repo := fs.String("repo", "", "`owner/name` of the repository (default $GITHUB_REPOSITORY)")
+	format := fs.String("format", "table", "output `format`: table, json or csv")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	var write func(io.Writer, []actionscache.CacheKey) error
+	switch *format {
+	case "table":
+		write = writeKeysTable
+	case "json":
+		write = writeKeysJSON
+	case "csv":
+		write = writeKeysCSV
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	api, err := newCommandRestAPI(*repo)
+	if err != nil {
+		return err
+	}
+
+	keys, err := filter.list(ctx, api)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(keys, func(a, b actionscache.CacheKey) int {
+		return cmp.Or(strings.Compare(b.LastAccessed, a.LastAccessed), strings.Compare(a.Key, b.Key))
+	})
+	return write(out, keys)
+}
+
+func writeKeysTable(out io.Writer, keys []actionscache.CacheKey) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tREF\tSIZE\tLAST ACCESSED\tCREATED")
+
+	var total int64
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", k.Key, k.Ref, formatBytes(int64(k.SizeInBytes)), k.LastAccessed, k.CreatedAt)
+		total += int64(k.SizeInBytes)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%d entries, %s\n", len(keys), formatBytes(total))
+	return err
+}
+
+func writeKeysJSON(out io.Writer, keys []actionscache.CacheKey) error {
+	if keys == nil {
+		keys = []actionscache.CacheKey{}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(keys)
+}
+
+func writeKeysCSV(out io.Writer, keys []actionscache.CacheKey) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"id", "key", "ref", "version", "size_in_bytes", "created_at", "last_accessed_at"})
+	for _, k := range keys {
+		w.Write([]string{
+			strconv.Itoa(k.ID),
+			k.Key,
+			k.Ref,
+			k.Version,
+			strconv.Itoa(k.SizeInBytes),
+			k.CreatedAt,
+			k.LastAccessed,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -5,26 +5,52 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
-	"maps"
+	"os"
+	"slices"
 	"strings"
 )
 
+const (
+	githubStepSummary = "GITHUB_STEP_SUMMARY"
+	githubOutput      = "GITHUB_OUTPUT"
+)
+
+// LevelNotice is between info and warning. Notice records are shown as
+// notice annotations on the workflow run.
+const LevelNotice = slog.Level(2)
+
+// titleKey is the attribute key used for the title of an annotation, e.g.
+// slog.Warn("...", titleKey, "Cache quota reached").
+const titleKey = "title"
+
 // GitHubActionsHandler is a custom slog handler that formats log output for GitHub Actions annotations.
 type GitHubActionsHandler struct {
 	level slog.Level
 	out   io.Writer
 
-	attrs map[string]slog.Value
+	// debugCommands writes debug records as ::debug:: commands, which the
+	// runner only shows with step debug logging enabled.
+	debugCommands bool
+
+	attrs []slog.Attr
 }
 
 // NewGitHubActionsHandler creates a new GitHubActionsHandler with the specified log level.
 func NewGitHubActionsHandler(level slog.Level, outStream io.Writer) *GitHubActionsHandler {
 	return &GitHubActionsHandler{
-		level: level,
-		out:   outStream,
+		level:         level,
+		out:           outStream,
+		debugCommands: runnerDebug(),
 	}
 }
 
+// runnerDebug reports whether step debug logging is enabled for the workflow
+// run, either by re-running it with debug logging or by the
+// ACTIONS_STEP_DEBUG secret.
+func runnerDebug() bool {
+	return os.Getenv("RUNNER_DEBUG") == "1" || os.Getenv("ACTIONS_STEP_DEBUG") == "true"
+}
+
 // Enabled reports whether the handler is enabled for the given level.
 func (h *GitHubActionsHandler) Enabled(ctx context.Context, level slog.Level) bool {
 	return level >= h.level
@@ -32,58 +58,115 @@ func (h *GitHubActionsHandler) Enabled(ctx context.Context, level slog.Level) bo
 
 // Handle formats the log record as a GitHub Actions annotation and prints it.
 func (h *GitHubActionsHandler) Handle(ctx context.Context, r slog.Record) error {
-	var annotationType string
-	switch r.Level {
-	case slog.LevelError:
-		annotationType = "error"
-	case slog.LevelWarn:
-		annotationType = "warning"
+	var command string
+	switch {
+	case r.Level >= slog.LevelError:
+		command = "error"
+	case r.Level >= slog.LevelWarn:
+		command = "warning"
+	case r.Level >= LevelNotice:
+		command = "notice"
+	case r.Level < slog.LevelInfo && h.debugCommands:
+		command = "debug"
 	}
 
-	var attrs []string
-	numAttrs := r.NumAttrs() + len(h.attrs)
-	if numAttrs > 0 {
-		attrs = make([]string, 0, numAttrs)
-		for k, v := range h.attrs {
-			attrs = append(attrs, k+"="+v.String())
+	var title string
+	attrs := make([]string, 0, len(h.attrs)+r.NumAttrs())
+	add := func(attr slog.Attr) bool {
+		if attr.Key == titleKey {
+			title = attr.Value.String()
+			return true
 		}
+		attrs = append(attrs, attr.Key+"="+attr.Value.String())
+		return true
+	}
+	for _, attr := range h.attrs {
+		add(attr)
+	}
+	r.Attrs(add)
 
-		r.Attrs(func(attr slog.Attr) bool {
-			attrs = append(attrs, attr.Key+"="+attr.Value.String())
-			return true
-		})
+	msg := r.Message
+	if len(attrs) > 0 {
+		msg += " (" + strings.Join(attrs, ", ") + ")"
 	}
 
-	if annotationType == "" {
-		fmt.Fprintf(h.out, "%s: %s (%s)\n", r.Level, r.Message, strings.Join(attrs, ", "))
-		return nil
+	if command == "" {
+		_, err := fmt.Fprintf(h.out, "%s: %s\n", r.Level, msg)
+		return err
 	}
 
-	fmt.Fprintf(h.out, "::%s::%s (%s)\n",
-		annotationType,
-		r.Message,
-		strings.Join(attrs, ", "),
-	)
-	return nil
+	var props string
+	if title != "" && command != "debug" {
+		props = " title=" + escapeProperty(title)
+	}
+	_, err := fmt.Fprintf(h.out, "::%s%s::%s\n", command, props, escapeData(msg))
+	return err
 }
 
 // WithAttrs returns a new handler with the given attributes.
 func (h *GitHubActionsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	newAttrs := maps.Clone(h.attrs)
-	if newAttrs == nil {
-		newAttrs = make(map[string]slog.Value, len(attrs))
-	}
-	for _, attr := range attrs {
-		newAttrs[attr.Key] = attr.Value
-	}
-	return &GitHubActionsHandler{
-		level: h.level,
-		out:   h.out,
-		attrs: newAttrs,
-	}
+	h2 := *h
+	h2.attrs = slices.Concat(h.attrs, attrs)
+	return &h2
 }
 
 // WithGroup returns a new handler with the given group name.
 func (h *GitHubActionsHandler) WithGroup(name string) slog.Handler {
 	return h
 }
+
+// escapeData escapes the message of a workflow command, so that it cannot
+// end the command early.
+func escapeData(s string) string {
+	return dataEscaper.Replace(s)
+}
+
+// escapeProperty escapes a property value of a workflow command.
+func escapeProperty(s string) string {
+	return propertyEscaper.Replace(s)
+}
+
+var (
+	dataEscaper     = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	propertyEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+)
+
+// appendStepSummary appends markdown to the job summary. It does nothing
+// outside of GitHub Actions.
+func appendStepSummary(markdown string) error {
+	return appendEnvFile(githubStepSummary, markdown)
+}
+
+// stepOutput is a single output of the current step.
+type stepOutput struct {
+	name  string
+	value string
+}
+
+// setStepOutputs sets outputs of the current step, which later steps can use.
+// Values must not contain newlines. It does nothing outside of GitHub Actions.
+func setStepOutputs(outputs []stepOutput) error {
+	var b strings.Builder
+	for _, o := range outputs {
+		fmt.Fprintf(&b, "%s=%s\n", o.name, o.value)
+	}
+	return appendEnvFile(githubOutput, b.String())
+}
+
+// appendEnvFile appends s to the file named by the environment variable
+// name, which the runner reads once the step is done.
+func appendEnvFile(name, s string) error {
+	path := os.Getenv(name)
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
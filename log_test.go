@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in       string
+		data     string
+		property string
+	}{
+		{"plain text", "plain text", "plain text"},
+		{"", "", ""},
+		{"100%", "100%25", "100%25"},
+		{"%0A", "%250A", "%250A"},
+		{"line\nbreak", "line%0Abreak", "line%0Abreak"},
+		{"carriage\r\nreturn", "carriage%0D%0Areturn", "carriage%0D%0Areturn"},
+		{"key: a, b", "key: a, b", "key%3A a%2C b"},
+		{"::error::injected", "::error::injected", "%3A%3Aerror%3A%3Ainjected"},
+		{"50%,\n:", "50%25,%0A:", "50%25%2C%0A%3A"},
+	}
+	for _, tt := range tests {
+		if got := escapeData(tt.in); got != tt.data {
+			t.Errorf("escapeData(%q) = %q, want %q", tt.in, got, tt.data)
+		}
+		if got := escapeProperty(tt.in); got != tt.property {
+			t.Errorf("escapeProperty(%q) = %q, want %q", tt.in, got, tt.property)
+		}
+	}
+}
+
+func TestGitHubActionsHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		debug bool
+		log   func(*slog.Logger)
+		want  string
+	}{
+		{
+			name: "error with title",
+			log: func(l *slog.Logger) {
+				l.Error("upload failed\nfor good", "key", "a,b", titleKey, "Cache: upload")
+			},
+			want: "::error title=Cache%3A upload::upload failed%0Afor good (key=a,b)\n",
+		},
+		{
+			name: "warning",
+			log:  func(l *slog.Logger) { l.Warn("quota at 100%") },
+			want: "::warning::quota at 100%25\n",
+		},
+		{
+			name: "notice",
+			log:  func(l *slog.Logger) { l.Log(context.Background(), LevelNotice, "resumed uploads", "count", 3) },
+			want: "::notice::resumed uploads (count=3)\n",
+		},
+		{
+			name: "info",
+			log:  func(l *slog.Logger) { l.With("prefix", "p").Info("listening", "socket", "s") },
+			want: "INFO: listening (prefix=p, socket=s)\n",
+		},
+		{
+			name: "debug without step debugging",
+			log:  func(l *slog.Logger) { l.Debug("lookup", titleKey, "ignored") },
+			want: "DEBUG: lookup\n",
+		},
+		{
+			name:  "debug with step debugging",
+			debug: true,
+			log:   func(l *slog.Logger) { l.Debug("lookup\ndone", titleKey, "ignored") },
+			want:  "::debug::lookup%0Adone\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			h := NewGitHubActionsHandler(slog.LevelDebug, &buf)
+			h.debugCommands = tt.debug
+			tt.log(slog.New(h))
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
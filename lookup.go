@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+const (
+	defaultLookupConcurrency = 8
+	defaultLookupTimeout     = 30 * time.Second
+	negativeCacheSize        = 16384
+	negativeCacheTTL         = 10 * time.Minute
+)
+
+// remoteLookup loads entries from the cache service directly.
+//
+// It is used for every entry that is fetched, and also to check for existence
+// when the key index is not complete, e.g. because there is no token for the
+// REST API or listing keys failed part way through.
+// Keys that were not found are remembered for a while so that repeated checks
+// do not hit the service again.
+type remoteLookup struct {
+	client  *actionscache.Cache
+	sem     chan struct{}
+	timeout time.Duration
+
+	mu       sync.Mutex
+	negative map[string]time.Time
+	order    []string // insertion order of negative, oldest first
+}
+
+func newRemoteLookup(client *actionscache.Cache, concurrency int, timeout time.Duration) *remoteLookup {
+	return &remoteLookup{
+		client:   client,
+		sem:      make(chan struct{}, concurrency),
+		timeout:  timeout,
+		negative: make(map[string]time.Time),
+	}
+}
+
+// load fetches the entry for key.
+// It returns nil if the key does not exist.
+func (l *remoteLookup) load(ctx context.Context, key string) (*actionscache.Entry, error) {
+	if l.isNegative(key) {
+		return nil, nil
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-l.sem }()
+
+	lookupCtx := ctx
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		lookupCtx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	entry, err := l.client.Load(lookupCtx, key)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(lookupCtx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("cache lookup timed out after %s: %w", l.timeout, context.DeadlineExceeded)
+		}
+		return nil, err
+	}
+
+	// Keys passed to Load are also used as prefixes, so make sure this is
+	// the entry that was asked for.
+	if entry == nil || entry.Key != key {
+		l.addNegative(key)
+		return nil, nil
+	}
+	return entry, nil
+}
+
+func (l *remoteLookup) isNegative(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t, ok := l.negative[key]
+	if !ok {
+		return false
+	}
+	if time.Since(t) > negativeCacheTTL {
+		delete(l.negative, key)
+		return false
+	}
+	return true
+}
+
+func (l *remoteLookup) addNegative(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.negative[key]; !ok {
+		l.order = append(l.order, key)
+	}
+	l.negative[key] = time.Now()
+
+	for len(l.negative) > negativeCacheSize && len(l.order) > 0 {
+		delete(l.negative, l.order[0])
+		l.order = l.order[1:]
+	}
+	if len(l.order) > 2*negativeCacheSize {
+		// Drop keys which were already removed from the map.
+		order := make([]string, 0, len(l.negative))
+		for _, k := range l.order {
+			if _, ok := l.negative[k]; ok {
+				order = append(order, k)
+			}
+		}
+		l.order = order
+	}
+}
+
+// forget removes key from the negative cache, e.g. after it was saved.
+func (l *remoteLookup) forget(key string) {
+	l.mu.Lock()
+	delete(l.negative, key)
+	l.mu.Unlock()
+}
@@ -5,27 +5,31 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
-	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/gocache/cachedir"
 	"github.com/pkg/errors"
 	actionscache "github.com/tonistiigi/go-actions-cache"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/singleflight"
 )
 
 func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	level := slog.LevelInfo
-	if v := os.Getenv("ACTIONS_CACHE_GO_DEBUG"); v != "" {
+	if v := os.Getenv("ACTIONS_CACHE_GO_DEBUG"); v != "" || runnerDebug() {
 		strconv.ParseBool(v)
 		level = slog.LevelDebug
 		slog.SetLogLoggerLevel(level)
@@ -40,7 +44,33 @@ func main() {
 	}
 
 	cacheDirPath := filepath.Join(homeDir, ".cache", "actions-cache-go")
-	if err := do(ctx, cacheDirPath, os.Stdin, os.Stdout); err != nil {
+
+	var cmd string
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+
+	switch cmd {
+	case "":
+		err = do(ctx, cacheDirPath, os.Stdin, os.Stdout)
+	case "daemon":
+		err = runDaemon(ctx, cacheDirPath)
+	case "client":
+		err = runClient(ctx, cacheDirPath, os.Stdin, os.Stdout)
+	case "flush":
+		err = runFlush(ctx, cacheDirPath)
+	case "prune":
+		err = runPrune(ctx, os.Args[2:], os.Stdout)
+	case "list":
+		err = runList(ctx, os.Args[2:], os.Stdout)
+	case "inspect":
+		err = runInspect(ctx, os.Args[2:], os.Stdout)
+	case "report":
+		err = runReport(ctx, os.Args[2:], os.Stdout)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -52,17 +82,63 @@ const (
 	actionsCacheV2              = "ACTIONS_CACHE_SERVICE_V2"
 	actionsToken                = "ACTIONS_RUNTIME_TOKEN"
 	actionsCacheGoPrefix        = "ACTIONS_CACHE_GO_PREFIX"
+	actionsCacheGoPack          = "ACTIONS_CACHE_GO_PACK"
+	actionsCacheGoPackSize      = "ACTIONS_CACHE_GO_PACK_SIZE"
+	actionsCacheGoCompression   = "ACTIONS_CACHE_GO_COMPRESSION"
+	actionsCacheGoCompressMin   = "ACTIONS_CACHE_GO_COMPRESSION_MIN_SIZE"
+	actionsCacheGoMode          = "ACTIONS_CACHE_GO_MODE"
+	actionsCacheGoLookupConc    = "ACTIONS_CACHE_GO_LOOKUP_CONCURRENCY"
+	actionsCacheGoLookupTimeout = "ACTIONS_CACHE_GO_LOOKUP_TIMEOUT"
+	actionsCacheGoIndex         = "ACTIONS_CACHE_GO_INDEX"
+	actionsCacheGoIndexMaxAge   = "ACTIONS_CACHE_GO_INDEX_MAX_AGE"
+	actionsCacheGoPrefetch      = "ACTIONS_CACHE_GO_PREFETCH"
+	actionsCacheGoPrefetchBytes = "ACTIONS_CACHE_GO_PREFETCH_BYTES"
+	actionsCacheGoPrefetchConc  = "ACTIONS_CACHE_GO_PREFETCH_CONCURRENCY"
+	actionsCacheGoTrace         = "ACTIONS_CACHE_GO_TRACE"
+	actionsCacheGoUploadConc    = "ACTIONS_CACHE_GO_UPLOAD_CONCURRENCY"
+	actionsCacheGoUploadBytes   = "ACTIONS_CACHE_GO_UPLOAD_MAX_BYTES"
+	actionsCacheGoDrainTimeout  = "ACTIONS_CACHE_GO_DRAIN_TIMEOUT"
+	actionsCacheGoBreakerLimit  = "ACTIONS_CACHE_GO_BREAKER_THRESHOLD"
+	actionsCacheGoBreakerProbe  = "ACTIONS_CACHE_GO_BREAKER_PROBE_INTERVAL"
+	actionsCacheGoGetBudget     = "ACTIONS_CACHE_GO_GET_BUDGET"
+	actionsCacheGoDownloadConc  = "ACTIONS_CACHE_GO_DOWNLOAD_CONCURRENCY"
+	actionsCacheGoRangedMin     = "ACTIONS_CACHE_GO_RANGED_MIN_SIZE"
+	actionsCacheGoStallTimeout  = "ACTIONS_CACHE_GO_STALL_TIMEOUT"
+	actionsCacheGoRemoteConc    = "ACTIONS_CACHE_GO_REMOTE_CONCURRENCY"
+	actionsCacheGoAPIURL        = "ACTIONS_CACHE_GO_API_URL"
+	actionsCacheGoAPIVersion    = "ACTIONS_CACHE_GO_API_VERSION"
+	actionsCacheGoQuotaBytes    = "ACTIONS_CACHE_GO_QUOTA_BYTES"
+	actionsCacheGoQuotaShare    = "ACTIONS_CACHE_GO_QUOTA_SHARE"
+	actionsCacheGoEvict         = "ACTIONS_CACHE_GO_EVICT"
+	actionsCacheGoMetricsFile   = "ACTIONS_CACHE_GO_METRICS_FILE"
+	actionsCacheGoMetricsFormat = "ACTIONS_CACHE_GO_METRICS_FORMAT"
+	actionsCacheGoSummary       = "ACTIONS_CACHE_GO_SUMMARY"
+	githubAPIURL                = "GITHUB_API_URL"
 	restAPIToken                = "GITHUB_TOKEN"
 	githubRepo                  = "GITHUB_REPOSITORY"
 	defaultActionsCacheGoPrefix = "actions-cache-go-"
 )
 
 func do(ctx context.Context, cacheDirPath string, in io.Reader, out io.Writer) error {
-	var (
-		isV2 bool
-		url  string
-	)
+	handler, err := newHandler(ctx, cacheDirPath)
+	if err != nil {
+		return err
+	}
+
+	srv := handler.newServer(handler.Close)
 
+	defer func() {
+		srv.Close(ctx)
+		if handler.summary {
+			handler.saveRunSummary(cacheDirPath)
+		}
+	}()
+	return srv.Run(ctx, in, out)
+}
+
+// cacheServiceURL returns the URL of the cache service from the environment,
+// and whether it is the v2 service.
+func cacheServiceURL() (url string, isV2 bool) {
 	// https://github.com/actions/toolkit/blob/2b08dc18f261b9fdd978b70279b85cbef81af8bc/packages/cache/src/internal/config.ts#L19
 	if v, ok := os.LookupEnv(actionsCacheV2); ok {
 		if b, err := strconv.ParseBool(v); err == nil && b {
@@ -81,34 +157,220 @@ func do(ctx context.Context, cacheDirPath string, in io.Reader, out io.Writer) e
 			url = v
 		}
 	}
+	return url, isV2
+}
+
+// newHandler creates a handler configured from the environment, and starts
+// loading the key index in the background.
+func newHandler(ctx context.Context, cacheDirPath string) (*handler, error) {
+	url, isV2 := cacheServiceURL()
 
 	prefix := defaultActionsCacheGoPrefix
 	if v, ok := os.LookupEnv(actionsCacheGoPrefix); ok {
 		prefix = v
 	}
 
-	if url == "" {
-		return fmt.Errorf("missing %q or %q environment variable", actionsCacheURL, actionsResultURL)
+	mode := accessReadWrite
+	modeSet := false
+	if v := os.Getenv(actionsCacheGoMode); v != "" {
+		m, err := parseAccessMode(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", actionsCacheGoMode, err)
+		}
+		mode = m
+		modeSet = true
+	}
+
+	if url == "" && mode != accessOff {
+		return nil, fmt.Errorf("missing %q or %q environment variable", actionsCacheURL, actionsResultURL)
+	}
+
+	pack, err := envBool(actionsCacheGoPack, false)
+	if err != nil {
+		return nil, err
+	}
+
+	packSize, err := envInt(actionsCacheGoPackSize, defaultPackSize)
+	if err != nil {
+		return nil, err
+	}
+
+	lookupConcurrency, err := envInt(actionsCacheGoLookupConc, defaultLookupConcurrency)
+	if err != nil {
+		return nil, err
 	}
 
-	client, err := actionscache.New(os.Getenv(actionsToken), url, isV2, actionscache.Opt{})
+	lookupTimeout, err := envDuration(actionsCacheGoLookupTimeout, defaultLookupTimeout)
 	if err != nil {
-		return fmt.Errorf("error creating cache client: %w", err)
+		return nil, err
 	}
 
+	useIndexEntry, err := envBool(actionsCacheGoIndex, true)
+	if err != nil {
+		return nil, err
+	}
+
+	indexMaxAge, err := envDuration(actionsCacheGoIndexMaxAge, defaultIndexMaxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	prefetch, err := envBool(actionsCacheGoPrefetch, false)
+	if err != nil {
+		return nil, err
+	}
+
+	prefetchBytes, err := envInt(actionsCacheGoPrefetchBytes, defaultPrefetchBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	prefetchConcurrency, err := envInt(actionsCacheGoPrefetchConc, defaultPrefetchConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	trace, err := envBool(actionsCacheGoTrace, false)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadConcurrency, err := envInt(actionsCacheGoUploadConc, defaultUploadConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadMaxBytes, err := envInt(actionsCacheGoUploadBytes, defaultUploadMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	drainTimeout, err := envDuration(actionsCacheGoDrainTimeout, defaultDrainTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	breakerThreshold, err := envInt(actionsCacheGoBreakerLimit, defaultBreakerThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	breakerProbeInterval, err := envDuration(actionsCacheGoBreakerProbe, defaultBreakerProbeInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	// The get budget adapts to the observed latency unless it is set.
+	var getBudget time.Duration
+	adaptiveBudget := true
+	if v := os.Getenv(actionsCacheGoGetBudget); v != "" && v != "auto" {
+		getBudget, err = envDuration(actionsCacheGoGetBudget, 0)
+		if err != nil {
+			return nil, err
+		}
+		adaptiveBudget = false
+	}
+
+	downloadConcurrency, err := envInt(actionsCacheGoDownloadConc, defaultDownloadConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	rangedMinSize, err := envInt(actionsCacheGoRangedMin, defaultRangedMinSize)
+	if err != nil {
+		return nil, err
+	}
+
+	stallTimeout, err := envDuration(actionsCacheGoStallTimeout, defaultStallTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteConcurrency, err := envInt(actionsCacheGoRemoteConc, defaultRemoteConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	quotaBytes, err := envInt(actionsCacheGoQuotaBytes, defaultQuotaBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	quotaShare, err := envFraction(actionsCacheGoQuotaShare, defaultQuotaShare)
+	if err != nil {
+		return nil, err
+	}
+
+	evict, err := envBool(actionsCacheGoEvict, false)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsFile := os.Getenv(actionsCacheGoMetricsFile)
+	metricsFormat, err := metricsFormat(metricsFile, os.Getenv(actionsCacheGoMetricsFormat))
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := envBool(actionsCacheGoSummary, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Throttling by the cache service limits the remote concurrency. The REST
+	// API has its own rate limits, so it gets a transport of its own which
+	// only honors Retry-After.
+	remoteLimit := newConcurrencyController(int(remoteConcurrency))
+	throttle := newThrottleTransport(http.DefaultTransport, remoteLimit)
+	httpClient := &http.Client{Transport: throttle}
+	restClient := &http.Client{Transport: newThrottleTransport(http.DefaultTransport, nil)}
+
+	var client *actionscache.Cache
+	if mode != accessOff {
+		client, err = actionscache.New(os.Getenv(actionsToken), url, isV2, actionscache.Opt{Client: httpClient})
+		if err != nil {
+			return nil, fmt.Errorf("error creating cache client: %w", err)
+		}
+
+		if !modeSet {
+			var reason string
+			mode, reason = defaultAccessMode(client)
+			if reason != "" {
+				slog.Log(ctx, LevelNotice, "using remote cache in "+mode.String()+" mode", "reason", reason, titleKey, "Go build cache")
+			}
+		}
+	}
+	slog.Debug("remote cache access", "mode", mode)
+
 	cacheDir, err := cachedir.New(cacheDirPath)
 	if err != nil {
-		return fmt.Errorf("error creating cache directory: %w", err)
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	tmpDir := filepath.Join(cacheDirPath, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating temp directory: %w", err)
+	}
+
+	journal, err := newJournal(cacheDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := parseCompression(os.Getenv(actionsCacheGoCompression), os.Getenv(actionsCacheGoCompressMin), tmpDir)
+	if err != nil {
+		return nil, err
 	}
 
 	var restAPI *RestAPI
 	token := os.Getenv(restAPIToken)
 	repo := os.Getenv(githubRepo)
-	if token != "" && repo != "" {
-		slog.Debug("creating rest api client", "repo", repo)
-		restAPI, err = NewRestAPI(repo, os.Getenv(restAPIToken), actionscache.Opt{})
+	if mode == accessOff {
+		// No remote access, so no need for the rest api either.
+	} else if token != "" && repo != "" {
+		restAPI, err = newRestAPIFromEnv(repo, token, restClient)
 		if err != nil {
-			return fmt.Errorf("error creating rest api client: %w", err)
+			return nil, err
 		}
 	} else {
 		if token == "" {
@@ -119,134 +381,494 @@ func do(ctx context.Context, cacheDirPath string, in io.Reader, out io.Writer) e
 		}
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	handler := &handler{
-		client:  client,
-		restAPI: restAPI,
-		local:   cacheDir,
-		prefix:  prefix,
+		ctx:      ctx,
+		cancel:   cancel,
+		client:   client,
+		restAPI:  restAPI,
+		local:    cacheDir,
+		index:    newKeyIndex(),
+		lookup:   newRemoteLookup(client, int(lookupConcurrency), lookupTimeout),
+		breaker:  newBreaker(int(breakerThreshold), breakerProbeInterval),
+		latency:  newLatencyTracker(getBudget, adaptiveBudget),
+		quota:    newQuota(quotaBytes, quotaShare, evict),
+		prefix:   prefix,
+		mode:     mode,
+		pack:     pack,
+		packSize: packSize,
+
+		compression: compression,
+
+		useIndexEntry: useIndexEntry,
+		indexMaxAge:   indexMaxAge,
+
+		journal:      journal,
+		drainTimeout: drainTimeout,
+
+		remoteLimit: remoteLimit,
+		throttle:    throttle,
+		downloads: &downloader{
+			httpClient:    httpClient,
+			tmpDir:        tmpDir,
+			concurrency:   int(downloadConcurrency),
+			rangedMinSize: rangedMinSize,
+			stallTimeout:  stallTimeout,
+		},
+
+		prefetchBytes:       prefetchBytes,
+		prefetchConcurrency: int(prefetchConcurrency),
+
+		metricsFile:   metricsFile,
+		metricsFormat: metricsFormat,
+		summary:       summary,
+	}
+
+	if trace && mode != accessOff {
+		handler.trace = newAccessTrace()
+		if handler.trace == nil {
+			slog.Info("missing " + githubRef + " environment variable, not using an access trace")
+		}
+	}
+
+	handler.uploads = newUploader(ctx, int(uploadConcurrency), uploadMaxBytes, handler.upload)
+	handler.metrics = handler.newMetrics()
+	if mode.canWrite() {
+		go handler.resumeUploads(ctx)
+		if restAPI != nil {
+			go handler.checkQuota(ctx)
+		}
 	}
 
 	go handler.initKeys(ctx)
 
-	srv := &gocache.Server{
-		Get:   handler.handleGet,
-		Put:   handler.handlePut,
-		Close: handler.Close,
+	if mode.canRead() {
+		if prefetch {
+			handler.startPrefetch(ctx, handler.prefetch)
+		}
+		if handler.trace != nil {
+			handler.startPrefetch(ctx, handler.prefetchTrace)
+		}
 	}
 
-	defer srv.Close(ctx)
-	return srv.Run(ctx, in, out)
+	return handler, nil
+}
+
+// newRestAPIFromEnv creates a REST API client for repo, using the API URL and
+// version from the environment.
+func newRestAPIFromEnv(repo, token string, httpClient *http.Client) (*RestAPI, error) {
+	// The runner sets GITHUB_API_URL for GitHub Enterprise Server and
+	// GHE.com, but it can be overridden.
+	apiURL := defaultAPIURL
+	if v := os.Getenv(githubAPIURL); v != "" {
+		apiURL = v
+	}
+	if v := os.Getenv(actionsCacheGoAPIURL); v != "" {
+		apiURL = v
+	}
+
+	apiVersion := defaultAPIVersion
+	switch v := os.Getenv(actionsCacheGoAPIVersion); v {
+	case "":
+	case "none":
+		apiVersion = ""
+	default:
+		apiVersion = v
+	}
+
+	slog.Debug("creating rest api client", "repo", repo, "url", apiURL)
+	restAPI, err := NewRestAPI(apiURL, apiVersion, repo, token, actionscache.Opt{Client: httpClient})
+	if err != nil {
+		return nil, fmt.Errorf("error creating rest api client: %w", err)
+	}
+	return restAPI, nil
 }
 
 type handler struct {
+	// ctx lives as long as the handler and is canceled by Close. It is used
+	// for work which outlives a single request.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	client  *actionscache.Cache
 	restAPI *RestAPI
 	local   *cachedir.Dir
 	prefix  string
+	mode    accessMode
 
 	flightGet singleflight.Group
-	flightPut singleflight.Group
+	// fetches tracks running fetches, which may outlive the gets that
+	// started them.
+	fetches sync.WaitGroup
+	latency *latencyTracker
+
+	// remoteLimit adapts the number of concurrent remote gets and puts to
+	// throttling by the service, which throttle reports.
+	remoteLimit *concurrencyController
+	throttle    *throttleTransport
+	downloads   *downloader
+	uploads     *uploader
+	// journal records uploads which have not finished yet, so they can be
+	// resumed by the next run.
+	journal *journal
+	// drainTimeout limits how long Close waits for uploads.
+	drainTimeout time.Duration
 
 	keysOnce sync.Once
-	keys     map[string]struct{}
-
-	wg sync.WaitGroup
+	index    *keyIndex
+	lookup   *remoteLookup
+	breaker  *breaker
+	quota    *quota
+
+	// useIndexEntry enables loading and publishing the key index as a cache
+	// entry (see selfindex.go).
+	useIndexEntry bool
+	indexMaxAge   time.Duration
+	// indexLoaded is set when the key index was loaded from a fresh index
+	// entry, and indexDirty once keys were added or removed since.
+	indexLoaded atomic.Bool
+	indexDirty  atomic.Bool
+	// indexListed is when the REST listing the key index was built from
+	// started. It is only set once the index is complete and was not loaded
+	// from an index entry.
+	indexListed time.Time
+
+	// pack enables bundling new objects into packs which are uploaded on
+	// Close instead of saving each object as it is put.
+	pack     bool
+	packSize int64
+	packMu   sync.Mutex
+	pending  []packMember
+
+	// compression is used to encode uploads. It is nil when compression is
+	// disabled, which still allows reading compressed entries.
+	compression *compression
+
+	// prefetchCtx is the context for background prefetching, which is
+	// canceled by stopPrefetch on Close.
+	prefetchMu          sync.Mutex
+	prefetchCtx         context.Context
+	stopPrefetch        context.CancelFunc
+	prefetchWg          sync.WaitGroup
+	prefetchBytes       int64
+	prefetchConcurrency int
+
+	// trace records the actions used during this run. It is nil when access
+	// traces are disabled.
+	trace *accessTrace
+
+	// metrics are written to metricsFile on Close, unless it is empty.
+	metrics       *metrics
+	metricsFile   string
+	metricsFormat string
+	// summary enables the job summary and step outputs written by flush.
+	summary bool
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
-// initKeys initializes the keys map with all keys from the remote cache.
+// initKeys fills the key index with all keys from the remote cache.
 // This is done only once and is cached for the lifetime of the handler.
 // This makes it so we don't need to make a network call for every key check.
+//
+// The published index entry is used if there is a fresh one, otherwise keys
+// are listed through the REST API. Keys are added to the index as each page
+// of the listing arrives, and the indexes of any packs are loaded as the
+// packs are discovered.
 func (h *handler) initKeys(ctx context.Context) {
 	h.keysOnce.Do(func() {
+		start := time.Now()
+		defer func() { h.metrics.initKeysSeconds.Set(time.Since(start).Seconds()) }()
+
+		if h.mode == accessOff {
+			h.index.finish(false)
+			return
+		}
+
+		var packs errgroup.Group
+		packs.SetLimit(packIndexLoadConcurrency)
+
+		addKeys := func(keys []actionscache.CacheKey) {
+			h.index.addKeys(keys)
+
+			for _, k := range keys {
+				if !strings.HasPrefix(k.Key, h.prefix+packKeyPrefix) {
+					continue
+				}
+				packs.Go(func() error {
+					h.loadPack(ctx, k.Key)
+					return nil
+				})
+			}
+		}
+
+		var complete bool
+		defer func() {
+			packs.Wait()
+			h.index.finish(complete)
+		}()
+
+		if h.useIndexEntry {
+			if keys, ok := h.loadIndexEntry(ctx); ok {
+				h.indexLoaded.Store(true)
+				complete = true
+				addKeys(keys)
+				return
+			}
+		}
+
 		if h.restAPI == nil {
 			return
 		}
 
+		listStart := time.Now()
 		for keys, err := range h.restAPI.ListKeys(ctx, h.prefix, "") {
 			if err != nil {
+				// Keep what was listed so far, but lookups for anything else
+				// will have to go to the cache service.
 				slog.Error("error listing keys", "error", err)
 				return
 			}
+			addKeys(keys)
+		}
+		h.indexListed = listStart
+		complete = true
+	})
+}
+
+// Close writes out any queued packs and waits for pending uploads.
+// Uploads that do not finish within the drain timeout are abandoned and left
+// in the journal for the next run.
+// It is safe to call more than once.
+func (h *handler) Close(ctx context.Context) error {
+	h.closeOnce.Do(func() {
+		h.prefetchMu.Lock()
+		if h.stopPrefetch != nil {
+			h.stopPrefetch()
+		}
+		h.prefetchMu.Unlock()
+		h.prefetchWg.Wait()
 
-			if h.keys == nil {
-				h.keys = make(map[string]struct{}, len(keys))
+		defer h.cancel()
+
+		drainCtx, cancel := context.WithTimeout(ctx, h.drainTimeout)
+		defer cancel()
+
+		// Packs go first: they hold many small objects in a few uploads, so
+		// they should not be starved by a drain that takes the whole timeout.
+		h.closeErr = h.flushPacks(drainCtx)
+
+		// Let downloads which went over their budget finish, so later runs
+		// can hit them locally.
+		fetched := make(chan struct{})
+		go func() {
+			h.fetches.Wait()
+			close(fetched)
+		}()
+		select {
+		case <-fetched:
+		case <-drainCtx.Done():
+		}
+
+		if err := h.uploads.wait(drainCtx); err != nil {
+			if n := h.uploads.abandon(); n > 0 {
+				slog.Warn(fmt.Sprintf("abandoned %d pending uploads, they will be retried by the next run", n))
 			}
-			for _, k := range keys {
-				h.keys[k.Key] = struct{}{}
+		}
+		h.uploads.close()
+		h.uploads.logSummary()
+		h.journal.close()
+
+		if h.useIndexEntry && h.mode.canWrite() {
+			if err := h.publishIndexEntry(drainCtx); err != nil {
+				slog.Error("error publishing key index", "error", err)
+			}
+		}
+
+		if h.trace != nil && h.mode.canWrite() {
+			if err := h.publishTrace(ctx); err != nil {
+				slog.Error("error publishing access trace", "error", err)
+			}
+		}
+		h.trace.logStats()
+
+		h.compression.logSavings()
+		h.latency.logSummary()
+		h.throttle.logSummary()
+		h.quota.logSummary()
+
+		if h.metricsFile != "" {
+			if err := h.writeMetrics(h.metricsFile, h.metricsFormat); err != nil {
+				slog.Error("error writing metrics", "path", h.metricsFile, "error", err)
 			}
 		}
 	})
+	return h.closeErr
 }
 
-func (h *handler) Close(ctx context.Context) error {
-	h.wg.Wait()
-	return nil
-}
+// exists reports whether key exists in the remote cache.
+// If the key is stored in a pack, its location is returned as well.
+//
+// If the key index is not complete, the cache service is asked directly.
+func (h *handler) exists(ctx context.Context, key string) (*packRef, bool) {
+	ref, found, complete := h.index.lookup(ctx, key)
+	if found || complete {
+		return ref, found
+	}
 
-func (h *handler) exists(ctx context.Context, key string) bool {
-	h.initKeys(ctx)
-	_, ok := h.keys[key]
-	return ok
+	entry, err := h.lookup.load(ctx, key)
+	if err != nil {
+		slog.Debug("error checking remote cache", "key", key, "error", err)
+		return nil, false
+	}
+	return nil, entry != nil
 }
 
 type getRet struct {
 	outputID string
 	diskPath string
+	// remote is set if the object was downloaded from the remote cache.
+	remote bool
 }
 
 func (h *handler) handleGet(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
-	actionID = h.prefix + actionID
+	actionID = h.objectKey(actionID)
 
-	v, err, _ := h.flightGet.Do(actionID, func() (interface{}, error) {
-		id, path, err := h.local.Get(ctx, actionID)
-		if err != nil {
-			return nil, err
-		}
-		if id != "" {
-			return &getRet{id, path}, nil
-		}
+	getCtx := ctx
+	if budget := h.latency.budget(); budget > 0 {
+		var cancel context.CancelFunc
+		getCtx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
 
-		if !h.exists(ctx, actionID) {
-			// Don't bother making a network call if the key doesn't exist
-			return nil, nil
-		}
+	ret, err := h.get(getCtx, actionID)
+	if err != nil && ctx.Err() == nil && errors.Is(getCtx.Err(), context.DeadlineExceeded) {
+		// Rebuilding is likely faster than waiting any longer. The download
+		// goes on in the background so that later gets can hit locally.
+		slog.Debug("remote get exceeded its time budget, reporting a miss", "actionID", actionID)
+		h.latency.expired.Add(1)
+		ret, err = nil, nil
+	}
+	h.trace.recordGet(actionID, ret != nil)
+	switch {
+	case err != nil:
+	case ret == nil:
+		h.metrics.misses.Add(1)
+	case ret.remote:
+		h.metrics.remoteHits.Add(1)
+	default:
+		h.metrics.localHits.Add(1)
+	}
+	if err != nil || ret == nil {
+		return "", "", err
+	}
+	return ret.outputID, ret.diskPath, nil
+}
 
-		entry, err := h.client.Load(ctx, actionID)
-		if err != nil {
-			return nil, fmt.Errorf("error loading cache key %q: %w", actionID, err)
-		}
-		if entry == nil {
-			slog.Debug("cache key not found", "actionID", actionID)
-			return nil, nil
+// get returns the object for actionID, fetching it from the remote cache if
+// it is not available locally. It returns nil on a cache miss.
+// Concurrent calls for the same action share a single fetch.
+//
+// The fetch is not tied to ctx: if ctx is done first, get returns but the
+// fetch carries on until the handler is closed.
+func (h *handler) get(ctx context.Context, actionID string) (*getRet, error) {
+	ch := h.flightGet.DoChan(actionID, func() (interface{}, error) {
+		h.fetches.Add(1)
+		defer h.fetches.Done()
+		return h.fetch(h.ctx, actionID)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
 		}
+		ret, _ := res.Val.(*getRet)
+		return ret, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-		slog.Debug("cache key found", "actionID", actionID)
+func (h *handler) fetch(ctx context.Context, actionID string) (*getRet, error) {
+	id, path, err := h.local.Get(ctx, actionID)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		return &getRet{outputID: id, diskPath: path}, nil
+	}
 
-		remote := entry.Download(ctx)
-		defer remote.Close()
+	if !h.mode.canRead() {
+		return nil, nil
+	}
 
-		obj := gocache.Object{
-			ActionID: actionID,
-			Body:     io.NewSectionReader(remote, 0, math.MaxInt64),
-			OutputID: actionID,
-		}
-		p, err := h.local.Put(ctx, obj)
-		if err != nil {
-			return nil, fmt.Errorf("error storing in local cache: %w", err)
+	indexStart := time.Now()
+	ref, found, complete := h.index.lookup(ctx, actionID)
+	h.metrics.indexWaitSeconds.Add(time.Since(indexStart).Seconds())
+	if !found && complete {
+		// Don't bother making a network call if the key doesn't exist
+		return nil, nil
+	}
+
+	if !h.breaker.allow() {
+		return nil, nil
+	}
+	if err := h.remoteLimit.acquire(ctx); err != nil {
+		h.breaker.done(err)
+		return nil, err
+	}
+	start := time.Now()
+	ret, err := h.fetchRemote(ctx, actionID, ref, found)
+	h.remoteLimit.release(err)
+	h.breaker.done(err)
+	if ret != nil {
+		h.latency.record(time.Since(start))
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
 		}
-		return &getRet{id, p}, nil
-	})
+		// The build can go on without the remote cache.
+		h.metrics.remoteErrors.Add(1)
+		slog.Debug("error fetching from remote cache, reporting a miss", "actionID", actionID, "class", classifyError(err), "error", err)
+		return nil, nil
+	}
+	return ret, nil
+}
 
-	if err != nil || v == nil {
-		return "", "", err
+// fetchRemote downloads the object for actionID from the remote cache into
+// the local cache. ref and found are the result of looking up actionID in the
+// key index.
+func (h *handler) fetchRemote(ctx context.Context, actionID string, ref *packRef, found bool) (*getRet, error) {
+	if ref != nil {
+		slog.Debug("cache key found in pack", "actionID", actionID)
+		return h.getPacked(ctx, actionID, *ref)
 	}
 
-	vv := v.(*getRet)
-	return vv.outputID, vv.diskPath, nil
+	loadStart := time.Now()
+	entry, err := h.lookup.load(ctx, actionID)
+	h.metrics.observe(h.metrics.load, "load", actionID, loadStart)
+	if err != nil {
+		return nil, fmt.Errorf("error loading cache key %q: %w", actionID, err)
+	}
+	if entry == nil {
+		slog.Debug("cache key not found", "actionID", actionID)
+		if found {
+			// The index is out of date, e.g. the entry was evicted.
+			h.index.remove(actionID)
+			h.indexDirty.Store(true)
+		}
+		return nil, nil
+	}
+
+	slog.Debug("cache key found", "actionID", actionID)
+	return h.getEntry(ctx, actionID, entry)
 }
 
 func (h *handler) handlePut(ctx context.Context, req gocache.Object) (diskPath string, _ error) {
-	req.ActionID = h.prefix + req.ActionID
+	req.ActionID = h.objectKey(req.ActionID)
 
 	p, err := h.local.Put(ctx, gocache.Object{
 		ActionID: req.ActionID,
@@ -258,58 +880,126 @@ func (h *handler) handlePut(ctx context.Context, req gocache.Object) (diskPath s
 		return "", fmt.Errorf("error storing in local cache: %w", err)
 	}
 
-	f, err := os.Open(p)
-	if err != nil {
-		return "", fmt.Errorf("error opening local cache file: %w", err)
+	if !h.mode.canWrite() {
+		return p, nil
+	}
+	h.trace.recordPut(req.ActionID)
+
+	h.journal.add(journalEntry{
+		ActionID: req.ActionID,
+		OutputID: req.OutputID,
+		Size:     req.Size,
+	})
+	h.scheduleUpload(&uploadTask{
+		actionID: req.ActionID,
+		outputID: req.OutputID,
+		size:     req.Size,
+		path:     p,
+	})
+	return p, nil
+}
+
+// scheduleUpload queues an object for upload, either on its own or as part of
+// a pack. The object must be in the journal already.
+func (h *handler) scheduleUpload(t *uploadTask) {
+	if h.pack {
+		h.queuePack(packMember{
+			actionID: t.actionID,
+			outputID: t.outputID,
+			size:     t.size,
+			path:     t.path,
+		})
+		return
 	}
 
-	h.wg.Add(1)
+	switch err := h.uploads.enqueue(t); err {
+	case errUploadsClosed:
+		slog.Debug("uploads are closed, carrying the upload over to the next run", "actionID", t.actionID)
+	case errUploadDone:
+		h.journal.remove(t.actionID)
+	}
+	// Otherwise the upload that is already scheduled removes the journal
+	// entry once it is done.
+}
 
-	go func() {
-		defer func() {
-			h.wg.Done()
-			f.Close()
-		}()
+// upload saves a single object to the remote cache. It is run by the upload
+// scheduler.
+func (h *handler) upload(ctx context.Context, t *uploadTask) (uploadState, error) {
+	state, err := h.saveObject(ctx, t)
+	if state == uploadDone || state == uploadSkipped {
+		h.journal.remove(t.actionID)
+	}
+	return state, err
+}
 
-		if h.exists(ctx, req.ActionID) {
-			// Don't need to upload if the cache already exists
-			return
+func (h *handler) saveObject(ctx context.Context, t *uploadTask) (uploadState, error) {
+	if _, ok := h.exists(ctx, t.actionID); ok {
+		// Don't need to upload if the cache already exists
+		return uploadSkipped, nil
+	}
+	if err := h.quota.allow(t.size); err != nil {
+		return uploadFailed, err
+	}
+	if !h.breaker.allow() {
+		return uploadFailed, errBreakerOpen
+	}
+	if err := h.remoteLimit.acquire(ctx); err != nil {
+		h.breaker.done(err)
+		return uploadFailed, err
+	}
+	state, err := h.saveRemote(ctx, t)
+	h.remoteLimit.release(err)
+	h.breaker.done(err)
+	return state, err
+}
+
+func (h *handler) saveRemote(ctx context.Context, t *uploadTask) (uploadState, error) {
+	blob, err := h.newEntryBlob(t.path, t.outputID, t.size)
+	if err != nil {
+		slog.Error("error preparing remote cache upload", "actionID", t.actionID, "error", err)
+		return uploadFailed, err
+	}
+	defer blob.Close()
+
+	saveStart := time.Now()
+	err = h.client.Save(ctx, t.actionID, blob)
+	h.metrics.observe(h.metrics.save, "save", t.actionID, saveStart)
+	if err != nil {
+		if isConflict(err) {
+			// Cache already exists
+			h.metrics.uploadConflicts.Add(1)
+			h.addSavedKey(t.actionID, blob.Size())
+			return uploadSkipped, nil
 		}
 
-		h.flightPut.Do(req.ActionID, func() (interface{}, error) {
-			blob := &sectionReaderCloser{io.NewSectionReader(f, 0, req.Size), f}
-			if err := h.client.Save(ctx, req.ActionID, blob); err != nil {
-				var he actionscache.HTTPError
-
-				var attrs []slog.Attr
-				attrs = append(attrs, slog.String("actionID", req.ActionID))
-				if errors.As(err, &he) {
-					if he.StatusCode == http.StatusConflict {
-						// Cache already exists
-						return nil, nil
-					}
-					attrs = append(attrs, slog.Int("statusCode", he.StatusCode))
-				}
-				attrs = append(attrs, slog.String("error", err.Error()))
-				slog.LogAttrs(ctx, slog.LevelError, "error saving remote cache", attrs...)
-			} else {
-				slog.Debug("saved remote cache", "actionID", req.ActionID)
-			}
-			return nil, nil
-		})
-	}()
+		var attrs []slog.Attr
+		attrs = append(attrs, slog.String("actionID", t.actionID))
+		var he actionscache.HTTPError
+		if errors.As(err, &he) {
+			attrs = append(attrs, slog.Int("statusCode", he.StatusCode))
+		}
+		attrs = append(attrs, slog.String("class", classifyError(err).String()))
+		attrs = append(attrs, slog.String("error", err.Error()))
+		slog.LogAttrs(ctx, slog.LevelError, "error saving remote cache", attrs...)
+		return uploadFailed, err
+	}
 
-	return p, nil
+	slog.Debug("saved remote cache", "actionID", t.actionID)
+	h.lookup.forget(t.actionID)
+	h.addSavedKey(t.actionID, blob.Size())
+	h.quota.add(blob.Size())
+	h.metrics.uploadBytes.Add(blob.Size())
+	return uploadDone, nil
 }
 
-type sectionReaderCloser struct {
-	*io.SectionReader
-	io.Closer
+// addSavedKey records a key that was saved during this run in the key index.
+func (h *handler) addSavedKey(key string, size int64) {
+	h.index.addKeys([]actionscache.CacheKey{{Key: key, SizeInBytes: int(size)}})
+	h.indexDirty.Store(true)
 }
 
-func (c *sectionReaderCloser) Close() error {
-	if c.Closer != nil {
-		return c.Closer.Close()
-	}
-	return nil
+// isConflict reports whether err indicates that the cache entry already exists.
+func isConflict(err error) bool {
+	var he actionscache.HTTPError
+	return errors.As(err, &he) && he.StatusCode == http.StatusConflict
 }
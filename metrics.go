@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/gocache"
+)
+
+const (
+	metricsFormatJSON       = "json"
+	metricsFormatPrometheus = "prometheus"
+
+	// metricsNamespace prefixes the names of the handler metrics in the
+	// Prometheus format, and serverNamespace those of the gocache server.
+	metricsNamespace = "actions_cache_go"
+	serverNamespace  = "gocache"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms.
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics are the counters of a handler. They are published through
+// gocache.Server.SetMetrics, and written to a file on Close if one is
+// configured.
+type metrics struct {
+	vars expvar.Map
+
+	localHits    expvar.Int
+	remoteHits   expvar.Int
+	misses       expvar.Int
+	remoteErrors expvar.Int
+
+	downloadBytes   expvar.Int
+	uploadBytes     expvar.Int
+	uploadConflicts expvar.Int
+	packsSaved      expvar.Int
+	packsFailed     expvar.Int
+
+	// initKeysSeconds is how long loading the key index took, and
+	// indexWaitSeconds the total time gets spent waiting for it.
+	initKeysSeconds  expvar.Float
+	indexWaitSeconds expvar.Float
+
+	load     *histogram
+	download *histogram
+	save     *histogram
+	slowest  slowOps
+
+	mu sync.Mutex
+	// servers are the gocache servers using the handler, whose metrics are
+	// added up when writing the metrics file. The counters of servers which
+	// are done, such as those of daemon clients that went away, are kept in
+	// doneServers instead.
+	servers     []*gocache.Server
+	doneServers map[string]int64
+}
+
+// newMetrics creates the metrics of h, including values which are derived
+// from the state of its other parts.
+func (h *handler) newMetrics() *metrics {
+	m := &metrics{
+		load:     newHistogram(latencyBuckets),
+		download: newHistogram(latencyBuckets),
+		save:     newHistogram(latencyBuckets),
+	}
+
+	m.vars.Set("local_hits", &m.localHits)
+	m.vars.Set("remote_hits", &m.remoteHits)
+	m.vars.Set("misses", &m.misses)
+	m.vars.Set("remote_errors", &m.remoteErrors)
+	m.vars.Set("download_bytes", &m.downloadBytes)
+	m.vars.Set("upload_bytes", &m.uploadBytes)
+	m.vars.Set("upload_conflicts", &m.uploadConflicts)
+	m.vars.Set("packs_saved", &m.packsSaved)
+	m.vars.Set("packs_failed", &m.packsFailed)
+	m.vars.Set("init_keys_seconds", &m.initKeysSeconds)
+	m.vars.Set("index_wait_seconds", &m.indexWaitSeconds)
+	m.vars.Set("load_seconds", m.load)
+	m.vars.Set("download_seconds", m.download)
+	m.vars.Set("save_seconds", m.save)
+
+	m.vars.Set("budget_expired", expvar.Func(func() any { return h.latency.expired.Load() }))
+	m.vars.Set("budget_seconds", expvar.Func(func() any { return h.latency.budget().Seconds() }))
+	for name, state := range map[string]uploadState{
+		"uploads_done":    uploadDone,
+		"uploads_skipped": uploadSkipped,
+		"uploads_failed":  uploadFailed,
+	} {
+		m.vars.Set(name, expvar.Func(func() any { return h.uploads.counts()[state] }))
+	}
+	m.vars.Set("uploads_pending", expvar.Func(func() any {
+		counts := h.uploads.counts()
+		return counts[uploadQueued] + counts[uploadRunning]
+	}))
+	m.vars.Set("uploads_over_quota", expvar.Func(func() any { return h.quota.blocked.Load() }))
+	m.vars.Set("throttled_requests", expvar.Func(func() any { return h.throttle.throttled.Load() }))
+	m.vars.Set("remote_concurrency", expvar.Func(func() any { return h.remoteLimit.currentLimit() }))
+	m.vars.Set("breaker_open", expvar.Func(func() any { return h.breaker.isOpen() }))
+
+	if c := h.compression; c != nil {
+		m.vars.Set("compression_upload_bytes", expvar.Func(func() any { return c.rawUp.Load() }))
+		m.vars.Set("compression_upload_compressed_bytes", expvar.Func(func() any { return c.encodedUp.Load() }))
+		m.vars.Set("compression_download_bytes", expvar.Func(func() any { return c.rawDown.Load() }))
+		m.vars.Set("compression_download_compressed_bytes", expvar.Func(func() any { return c.encodedDown.Load() }))
+	}
+
+	if t := h.trace; t != nil {
+		for name, stat := range map[string]func(traceStats) int{
+			"trace_predicted":          func(s traceStats) int { return s.predicted },
+			"trace_unused":             func(s traceStats) int { return s.unused },
+			"trace_predicted_hits":     func(s traceStats) int { return s.predictedHits },
+			"trace_predicted_misses":   func(s traceStats) int { return s.predictedMisses },
+			"trace_unpredicted_hits":   func(s traceStats) int { return s.unpredictedHits },
+			"trace_unpredicted_misses": func(s traceStats) int { return s.unpredictedMisses },
+		} {
+			m.vars.Set(name, expvar.Func(func() any { return stat(t.stats()) }))
+		}
+	}
+	return m
+}
+
+// observe records the duration of a remote operation on key which started at
+// start in h.
+func (m *metrics) observe(h *histogram, op, key string, start time.Time) {
+	d := time.Since(start)
+	h.observe(d)
+	m.slowest.record(remoteOp{Op: op, Key: key, Duration: d})
+}
+
+// newServer returns a gocache server for h which publishes the handler
+// metrics. close is called when the server is closed.
+func (h *handler) newServer(close func(context.Context) error) *gocache.Server {
+	srv := &gocache.Server{
+		Get:   h.handleGet,
+		Put:   h.handlePut,
+		Close: close,
+		SetMetrics: func(_ context.Context, m *expvar.Map) {
+			h.metrics.vars.Do(func(kv expvar.KeyValue) {
+				m.Set(kv.Key, kv.Value)
+			})
+		},
+	}
+
+	h.metrics.mu.Lock()
+	h.metrics.servers = append(h.metrics.servers, srv)
+	h.metrics.mu.Unlock()
+	return srv
+}
+
+// removeServer stops tracking srv once it is done, keeping its counters.
+func (m *metrics) removeServer(srv *gocache.Server) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.Index(m.servers, srv)
+	if i < 0 {
+		return
+	}
+	m.servers = slices.Delete(m.servers, i, i+1)
+	if m.doneServers == nil {
+		m.doneServers = make(map[string]int64)
+	}
+	addServerCounters(m.doneServers, srv)
+}
+
+// serverMetrics adds up the request counters of all servers.
+func (m *metrics) serverMetrics() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := maps.Clone(m.doneServers)
+	if total == nil {
+		total = make(map[string]int64)
+	}
+	for _, srv := range m.servers {
+		addServerCounters(total, srv)
+	}
+	return total
+}
+
+func addServerCounters(total map[string]int64, srv *gocache.Server) {
+	sm, ok := srv.Metrics().Get("server").(*expvar.Map)
+	if !ok {
+		return
+	}
+	sm.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			total[kv.Key] += v.Value()
+		}
+	})
+}
+
+// writeMetrics writes the metrics to path, as JSON or in the Prometheus text
+// format.
+func (h *handler) writeMetrics(path, format string) error {
+	var buf bytes.Buffer
+	switch format {
+	case metricsFormatJSON:
+		host := make(map[string]json.RawMessage)
+		h.metrics.vars.Do(func(kv expvar.KeyValue) {
+			host[kv.Key] = json.RawMessage(kv.Value.String())
+		})
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]any{
+			"host":   host,
+			"server": h.metrics.serverMetrics(),
+		}); err != nil {
+			return err
+		}
+	case metricsFormatPrometheus:
+		h.metrics.writePrometheus(&buf)
+	default:
+		return fmt.Errorf("unknown metrics format %q", format)
+	}
+
+	if err := atomicfile.WriteData(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+	slog.Debug("wrote metrics", "path", path, "format", format)
+	return nil
+}
+
+// writePrometheus writes the metrics in the Prometheus text format.
+func (m *metrics) writePrometheus(w io.Writer) {
+	m.vars.Do(func(kv expvar.KeyValue) {
+		name := metricsNamespace + "_" + kv.Key
+		switch v := kv.Value.(type) {
+		case *histogram:
+			v.writePrometheus(w, name)
+		case *expvar.Int:
+			fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", name, name, v.Value())
+		case *expvar.Float:
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %s\n", name, name, formatFloat(v.Value()))
+		case expvar.Func:
+			var value string
+			switch x := v.Value().(type) {
+			case bool:
+				value = "0"
+				if x {
+					value = "1"
+				}
+			case float64:
+				value = formatFloat(x)
+			default:
+				value = fmt.Sprint(x)
+			}
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %s\n", name, name, value)
+		}
+	})
+
+	server := m.serverMetrics()
+	for _, key := range slices.Sorted(maps.Keys(server)) {
+		name := serverNamespace + "_" + key
+		fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", name, name, server[key])
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// histogram counts durations in buckets. It implements expvar.Var.
+type histogram struct {
+	bounds []float64 // upper bounds in seconds
+	counts []atomic.Int64
+	count  atomic.Int64
+	sum    atomic.Int64 // nanoseconds
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]atomic.Int64, len(bounds)),
+	}
+}
+
+// observe records a single duration.
+func (h *histogram) observe(d time.Duration) {
+	if i, _ := slices.BinarySearch(h.bounds, d.Seconds()); i < len(h.bounds) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// cumulative returns the number of observations up to each bound.
+func (h *histogram) cumulative() []int64 {
+	out := make([]int64, len(h.bounds))
+	var n int64
+	for i := range h.counts {
+		n += h.counts[i].Load()
+		out[i] = n
+	}
+	return out
+}
+
+// String returns the histogram as JSON, with cumulative bucket counts keyed
+// by their upper bound.
+func (h *histogram) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `{"count":%d,"sum":%s,"buckets":{`, h.count.Load(), formatFloat(time.Duration(h.sum.Load()).Seconds()))
+	for i, n := range h.cumulative() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `"%s":%d`, formatFloat(h.bounds[i]), n)
+	}
+	b.WriteString("}}")
+	return b.String()
+}
+
+func (h *histogram) writePrometheus(w io.Writer, name string) {
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, n := range h.cumulative() {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(h.bounds[i]), n)
+	}
+	count := h.count.Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(time.Duration(h.sum.Load()).Seconds()))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+// metricsFormat returns the format to write the metrics file at path in:
+// format if it is set, otherwise Prometheus for .prom files and JSON for
+// anything else.
+func metricsFormat(path, format string) (string, error) {
+	switch format {
+	case "":
+		if strings.HasSuffix(path, ".prom") {
+			return metricsFormatPrometheus, nil
+		}
+		return metricsFormatJSON, nil
+	case metricsFormatJSON, metricsFormatPrometheus:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid value for %s: %q", actionsCacheGoMetricsFormat, format)
+	}
+}
+
+// slowOpsKept is the number of slowest remote operations kept.
+const slowOpsKept = 5
+
+type remoteOp struct {
+	Op       string        `json:"op"`
+	Key      string        `json:"key"`
+	Duration time.Duration `json:"duration"`
+}
+
+// slowOps keeps the slowest remote operations.
+type slowOps struct {
+	mu  sync.Mutex
+	ops []remoteOp // slowest first
+}
+
+func (s *slowOps) record(op remoteOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.ops) == slowOpsKept && op.Duration <= s.ops[len(s.ops)-1].Duration {
+		return
+	}
+	i, _ := slices.BinarySearchFunc(s.ops, op, func(a, b remoteOp) int {
+		return cmp.Compare(b.Duration, a.Duration)
+	})
+	s.ops = slices.Insert(s.ops, i, op)
+	if len(s.ops) > slowOpsKept {
+		s.ops = s.ops[:slowOpsKept]
+	}
+}
+
+// list returns the slowest operations, slowest first.
+func (s *slowOps) list() []remoteOp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.ops)
+}
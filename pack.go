@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/creachadair/gocache"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// Pack files bundle many cache objects into a single Actions cache entry so
+// that a build with thousands of small outputs does not pay a
+// reserve/upload/commit round trip for each one.
+//
+// A pack is a framed index (see encodeFrame) followed by the member data.
+// The index lists every member along with its offset relative to the start of
+// the data section, so a single member can be fetched with a ranged read.
+const (
+	packMagic   = "acgopack"
+	packVersion = 1
+	// packKeyPrefix is appended to the configured key prefix to name packs.
+	packKeyPrefix            = "pack-"
+	defaultPackSize          = 256 << 20
+	packIndexLoadConcurrency = 8
+)
+
+// packEntry describes a single object stored in a pack.
+type packEntry struct {
+	ActionID string `json:"action_id"`
+	OutputID string `json:"output_id"`
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	// Codec and Length describe how the member is encoded in the pack.
+	// When Length is zero the member is stored as-is and takes Size bytes.
+	Codec  string `json:"codec,omitempty"`
+	Length int64  `json:"length,omitempty"`
+}
+
+type packIndex struct {
+	Entries []packEntry `json:"entries"`
+}
+
+// packRef locates an object inside a remote pack.
+type packRef struct {
+	entry    *actionscache.Entry
+	offset   int64 // absolute offset within the pack
+	length   int64 // encoded length within the pack
+	size     int64
+	codec    string
+	outputID string
+}
+
+// packMember is an object that is waiting to be written into a pack.
+type packMember struct {
+	actionID string
+	outputID string
+	size     int64
+	path     string
+}
+
+func encodePackHeader(idx packIndex) ([]byte, error) {
+	return encodeFrame(packMagic, packVersion, idx)
+}
+
+// readPackIndex reads the index from the start of a pack.
+// It returns the index along with the offset of the data section.
+func readPackIndex(r io.ReaderAt) (packIndex, int64, error) {
+	var idx packIndex
+
+	version, n, err := readFrame(io.NewSectionReader(r, 0, math.MaxInt64), packMagic, &idx)
+	if err != nil {
+		return idx, 0, fmt.Errorf("error reading pack index: %w", err)
+	}
+	if version != packVersion {
+		return idx, 0, fmt.Errorf("unsupported pack version %d", version)
+	}
+	return idx, n, nil
+}
+
+// splitPacks groups members into packs of at most maxSize bytes.
+// A member that is larger than maxSize gets a pack of its own.
+func splitPacks(members []packMember, maxSize int64) [][]packMember {
+	var (
+		out  [][]packMember
+		cur  []packMember
+		size int64
+	)
+	for _, m := range members {
+		if len(cur) > 0 && size+m.size > maxSize {
+			out = append(out, cur)
+			cur, size = nil, 0
+		}
+		cur = append(cur, m)
+		size += m.size
+	}
+	if len(cur) > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+// queuePack records an object to be included in a pack at Close.
+func (h *handler) queuePack(m packMember) {
+	h.packMu.Lock()
+	h.pending = append(h.pending, m)
+	h.packMu.Unlock()
+}
+
+// flushPacks writes all queued objects into packs and uploads them.
+func (h *handler) flushPacks(ctx context.Context) error {
+	h.packMu.Lock()
+	pending := h.pending
+	h.pending = nil
+	h.packMu.Unlock()
+
+	var members []packMember
+	for _, m := range pending {
+		if _, ok := h.exists(ctx, m.actionID); ok {
+			h.journal.remove(m.actionID)
+			continue
+		}
+		members = append(members, m)
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	sort.Slice(members, func(i, j int) bool { return members[i].actionID < members[j].actionID })
+
+	groups := splitPacks(members, h.packSize)
+
+	var errs []error
+	for _, group := range groups {
+		var size int64
+		for _, m := range group {
+			size += m.size
+		}
+		if err := h.quota.allow(size); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !h.breaker.allow() {
+			errs = append(errs, errBreakerOpen)
+			continue
+		}
+		if err := h.remoteLimit.acquire(ctx); err != nil {
+			h.breaker.done(err)
+			errs = append(errs, err)
+			continue
+		}
+		err := h.savePack(ctx, group)
+		h.remoteLimit.release(err)
+		h.breaker.done(err)
+		if err != nil {
+			slog.Error("error saving pack", "members", len(group), "error", err)
+			h.metrics.packsFailed.Add(1)
+			errs = append(errs, err)
+			continue
+		}
+		h.metrics.packsSaved.Add(1)
+		for _, m := range group {
+			h.journal.remove(m.actionID)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error saving %d of %d packs: %w", len(errs), len(groups), errs[0])
+	}
+	return nil
+}
+
+func (h *handler) savePack(ctx context.Context, members []packMember) error {
+	var (
+		idx  packIndex
+		off  int64
+		objs = make([]encodedObject, 0, len(members))
+	)
+	defer func() {
+		for _, obj := range objs {
+			if obj.temp {
+				os.Remove(obj.path)
+			}
+		}
+	}()
+
+	for _, m := range members {
+		obj, err := h.compression.encode(m.path, m.size)
+		if err != nil {
+			return err
+		}
+		objs = append(objs, obj)
+
+		idx.Entries = append(idx.Entries, packEntry{
+			ActionID: m.actionID[len(h.prefix):],
+			OutputID: m.outputID,
+			Offset:   off,
+			Size:     m.size,
+			Codec:    obj.codec,
+			Length:   obj.size,
+		})
+		off += obj.size
+	}
+
+	header, err := encodePackHeader(idx)
+	if err != nil {
+		return fmt.Errorf("error encoding pack index: %w", err)
+	}
+
+	// Name the pack after its contents so that identical packs from
+	// concurrent jobs collapse into one entry.
+	sum := sha256.Sum256(header)
+	key := h.prefix + packKeyPrefix + hex.EncodeToString(sum[:16])
+
+	blob := newConcatBlob(header)
+	defer blob.Close()
+	for i, obj := range objs {
+		if err := blob.addObject(obj); err != nil {
+			return err
+		}
+		// The blob owns the file now.
+		objs[i].temp = false
+	}
+
+	saveStart := time.Now()
+	err = h.client.Save(ctx, key, blob)
+	h.metrics.observe(h.metrics.save, "save", key, saveStart)
+	if err != nil {
+		if isConflict(err) {
+			h.metrics.uploadConflicts.Add(1)
+			return nil
+		}
+		return err
+	}
+
+	slog.Debug("saved pack", "key", key, "members", len(members), "size", blob.Size())
+	h.addSavedKey(key, blob.Size())
+	h.quota.add(blob.Size())
+	h.metrics.uploadBytes.Add(blob.Size())
+	return nil
+}
+
+// loadPack reads the index of the pack stored at key and records where each
+// member lives.
+func (h *handler) loadPack(ctx context.Context, key string) {
+	refs, err := readPackRefs(ctx, h.client, h.prefix, key)
+	if err != nil {
+		slog.Error("error loading pack", "key", key, "error", err)
+		return
+	}
+	if refs != nil {
+		slog.Debug("loaded pack index", "key", key, "objects", len(refs))
+		h.index.addPacks(refs)
+	}
+}
+
+// readPackRefs reads the index of the pack stored at key and returns where
+// each member lives, by key. It returns nil if there is no such pack.
+func readPackRefs(ctx context.Context, client *actionscache.Cache, prefix, key string) (map[string]packRef, error) {
+	entry, err := client.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.Key != key {
+		return nil, nil
+	}
+
+	remote := entry.Download(ctx)
+	idx, dataOffset, err := readPackIndex(remote)
+	remote.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading pack index: %w", err)
+	}
+
+	refs := make(map[string]packRef, len(idx.Entries))
+	for _, e := range idx.Entries {
+		if err := checkOutputID(e.OutputID); err != nil {
+			slog.Warn("ignoring packed cache entry", "key", key, "actionID", e.ActionID, "error", err)
+			continue
+		}
+		length := e.Length
+		if length == 0 {
+			length = e.Size
+		}
+		refs[prefix+e.ActionID] = packRef{
+			entry:    entry,
+			offset:   dataOffset + e.Offset,
+			length:   length,
+			size:     e.Size,
+			codec:    e.Codec,
+			outputID: e.OutputID,
+		}
+	}
+	return refs, nil
+}
+
+// getPacked fetches a single object out of a remote pack and stores it in
+// the local cache.
+func (h *handler) getPacked(ctx context.Context, actionID string, ref packRef) (*getRet, error) {
+	start := time.Now()
+	remote, release, err := h.downloads.openRange(ctx, ref.entry, ref.offset, ref.length)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading packed cache entry %q: %w", actionID, err)
+	}
+	defer release()
+	rdr := &countReader{r: remote}
+
+	body, done, err := h.compression.decode(rdr, ref.codec, ref.size)
+	if err != nil {
+		if errors.Is(err, errVerify) {
+			slog.Warn("ignoring packed cache entry", "actionID", actionID, "error", err)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	p, err := h.local.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: ref.outputID,
+		Size:     ref.size,
+		Body:     newVerifyReader(body, ref.outputID, ref.size),
+	})
+	done()
+	if err != nil {
+		if errors.Is(err, errVerify) {
+			slog.Warn("ignoring packed cache entry", "actionID", actionID, "error", err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error storing in local cache: %w", err)
+	}
+	h.metrics.downloadBytes.Add(rdr.n)
+	h.metrics.observe(h.metrics.download, "download", actionID, start)
+	return &getRet{outputID: ref.outputID, diskPath: p, remote: true}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultPrefetchBytes       = 1 << 30
+	defaultPrefetchConcurrency = 4
+)
+
+// prefetchCandidate is a remote object that may be downloaded ahead of time.
+type prefetchCandidate struct {
+	actionID     string
+	size         int64
+	lastAccessed time.Time
+}
+
+// startPrefetch runs fn in the background to download remote objects into
+// the local cache, so that later gets do not have to wait for the network.
+// Gets for an object that is being prefetched join the running download.
+// Prefetching is stopped on Close.
+func (h *handler) startPrefetch(ctx context.Context, fn func(context.Context)) {
+	h.prefetchMu.Lock()
+	if h.prefetchCtx == nil {
+		h.prefetchCtx, h.stopPrefetch = context.WithCancel(ctx)
+	}
+	ctx = h.prefetchCtx
+	h.prefetchMu.Unlock()
+
+	h.prefetchWg.Add(1)
+	go func() {
+		defer h.prefetchWg.Done()
+		fn(ctx)
+	}()
+}
+
+// prefetch downloads the objects in the key index, once it is loaded, up to
+// the prefetch byte budget.
+func (h *handler) prefetch(ctx context.Context) {
+	h.index.wait(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	candidates := h.prefetchCandidates()
+	start := time.Now()
+
+	var (
+		fetched, bytes atomic.Int64
+		budget         = h.prefetchBytes
+	)
+
+	var eg errgroup.Group
+	eg.SetLimit(h.prefetchConcurrency)
+	for _, c := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		if c.size > budget {
+			// Smaller objects further down may still fit.
+			continue
+		}
+		if id, _, err := h.local.Get(ctx, c.actionID); err == nil && id != "" {
+			continue
+		}
+		budget -= c.size
+
+		eg.Go(func() error {
+			ret, err := h.get(ctx, c.actionID)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Debug("error prefetching cache key", "actionID", c.actionID, "error", err)
+				}
+				return nil
+			}
+			if ret != nil {
+				fetched.Add(1)
+				bytes.Add(c.size)
+			}
+			return nil
+		})
+	}
+	eg.Wait()
+
+	slog.Debug("prefetch finished",
+		"candidates", len(candidates),
+		"fetched", fetched.Load(),
+		"bytes", bytes.Load(),
+		"duration", time.Since(start),
+	)
+}
+
+// prefetchCandidates returns the objects in the key index, most recently
+// used first and, among those used at the same time, smallest first.
+func (h *handler) prefetchCandidates() []prefetchCandidate {
+	keys, _ := h.index.snapshot()
+
+	lastAccessed := make(map[string]time.Time, len(keys))
+	var candidates []prefetchCandidate
+	for _, k := range keys {
+		t, _ := time.Parse(time.RFC3339, k.LastAccessed)
+		lastAccessed[k.Key] = t
+
+		if strings.HasPrefix(k.Key, h.prefix+packKeyPrefix) || isIndexEntryKey(h.prefix, k.Key) || isTraceKey(h.prefix, k.Key) {
+			continue
+		}
+		candidates = append(candidates, prefetchCandidate{
+			actionID:     k.Key,
+			size:         int64(k.SizeInBytes),
+			lastAccessed: t,
+		})
+	}
+
+	// Packed objects have no access time of their own, so use the pack's.
+	for actionID, ref := range h.index.packRefs() {
+		candidates = append(candidates, prefetchCandidate{
+			actionID:     actionID,
+			size:         ref.length,
+			lastAccessed: lastAccessed[ref.entry.Key],
+		})
+	}
+
+	slices.SortFunc(candidates, func(a, b prefetchCandidate) int {
+		if c := b.lastAccessed.Compare(a.lastAccessed); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.size, b.size)
+	})
+	return candidates
+}
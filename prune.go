@@ -0,0 +1,118 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+	"golang.org/x/sync/errgroup"
+)
+
+// pruneConcurrency is the number of entries deleted in parallel.
+const pruneConcurrency = 4
+
+// runPrune implements the prune command, which deletes entries from the
+// remote cache through the REST API.
+//
+// Every entry selected by the filter flags is deleted. With -max-size, only
+// the least recently used of the selected entries are deleted, until the rest
+// fit in the given size.
+func runPrune(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	var filter keyFilter
+	filter.register(fs)
+	repo := fs.String("repo", "", "`owner/name` of the repository (default $GITHUB_REPOSITORY)")
+	maxSize := fs.Int64("max-size", 0, "keep the most recently used entries up to a total of `bytes`, and delete the rest")
+	dryRun := fs.Bool("dry-run", false, "only print what would be deleted")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if filter.ref == "" && filter.accessedBefore.IsZero() && filter.createdBefore.IsZero() && filter.minSize == 0 && *maxSize == 0 {
+		return fmt.Errorf("refusing to delete every entry under %q, add a filter or -max-size", filter.prefix)
+	}
+
+	api, err := newCommandRestAPI(*repo)
+	if err != nil {
+		return err
+	}
+
+	keys, err := filter.list(ctx, api)
+	if err != nil {
+		return err
+	}
+
+	// Most recently used first.
+	slices.SortFunc(keys, func(a, b actionscache.CacheKey) int {
+		return cmp.Or(strings.Compare(b.LastAccessed, a.LastAccessed), strings.Compare(a.Key, b.Key))
+	})
+	if *maxSize > 0 {
+		var total int64
+		keep := 0
+		for _, k := range keys {
+			if total+int64(k.SizeInBytes) > *maxSize {
+				break
+			}
+			total += int64(k.SizeInBytes)
+			keep++
+		}
+		keys = keys[keep:]
+	}
+
+	var (
+		mu      sync.Mutex
+		deleted int
+		freed   int64
+		failed  []error
+	)
+	report := func(k actionscache.CacheKey, verb string) {
+		fmt.Fprintf(out, "%s %s (%s, %s, last accessed %s)\n", verb, k.Key, k.Ref, formatBytes(int64(k.SizeInBytes)), k.LastAccessed)
+	}
+
+	if *dryRun {
+		for _, k := range keys {
+			report(k, "would delete")
+			freed += int64(k.SizeInBytes)
+		}
+		fmt.Fprintf(out, "would delete %d entries, freeing %s\n", len(keys), formatBytes(freed))
+		return nil
+	}
+
+	var eg errgroup.Group
+	eg.SetLimit(pruneConcurrency)
+	for _, k := range keys {
+		eg.Go(func() error {
+			err := api.DeleteCache(ctx, k.ID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = append(failed, fmt.Errorf("error deleting %s: %w", k.Key, err))
+				return nil
+			}
+			report(k, "deleted")
+			deleted++
+			freed += int64(k.SizeInBytes)
+			return nil
+		})
+	}
+	eg.Wait()
+
+	fmt.Fprintf(out, "deleted %d entries, freed %s\n", deleted, formatBytes(freed))
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to delete %d entries: %w", len(failed), errors.Join(failed...))
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+const (
+	// defaultQuotaBytes is the cache size limit GitHub applies to a
+	// repository unless it was raised.
+	defaultQuotaBytes = 10 << 30
+	defaultQuotaShare = 0.8
+
+	// Eviction frees space until usage is at evictTarget of the share, so
+	// that the next few uploads do not have to evict again.
+	evictTarget = 0.9
+
+	quotaCheckTimeout = time.Minute
+)
+
+// errQuotaExceeded is returned for uploads which were held back because the
+// repository cache is full.
+var errQuotaExceeded = errors.New("repository cache quota exceeded")
+
+// quota keeps uploads within a share of the repository cache size limit.
+// Once the limit is reached, GitHub evicts the least recently used entries of
+// the repository, which may belong to other workflows, so it is better to
+// stop uploading before that happens.
+//
+// Usage is only known once it was fetched through the REST API. Until then,
+// or without a token, every upload is allowed.
+type quota struct {
+	// limit is the number of bytes the repository cache may use before
+	// uploads stop.
+	limit int64
+	evict bool
+
+	known   atomic.Bool
+	used    atomic.Int64
+	blocked atomic.Int64
+	warn    sync.Once
+}
+
+func newQuota(total int64, share float64, evict bool) *quota {
+	return &quota{limit: int64(float64(total) * share), evict: evict}
+}
+
+// allow reports whether an upload of size bytes fits in the quota.
+// Concurrent uploads are not accounted for, so usage may go over the limit by
+// the size of the uploads in flight.
+func (q *quota) allow(size int64) error {
+	if !q.known.Load() {
+		return nil
+	}
+	used := q.used.Load()
+	if used+size <= q.limit {
+		return nil
+	}
+	q.blocked.Add(1)
+	q.warn.Do(func() {
+		slog.Warn(fmt.Sprintf("repository cache is using %s of %s, not uploading any more entries", formatBytes(used), formatBytes(q.limit)), titleKey, "Cache quota reached")
+	})
+	return errQuotaExceeded
+}
+
+// add records size bytes saved to the remote cache.
+func (q *quota) add(size int64) {
+	q.used.Add(size)
+}
+
+// logSummary logs how many uploads were held back by the quota.
+func (q *quota) logSummary() {
+	if n := q.blocked.Load(); n > 0 {
+		slog.Info("cache quota", "used", q.used.Load(), "limit", q.limit, "blocked", n)
+	}
+}
+
+// checkQuota fetches the cache usage of the repository, and evicts our own
+// least recently used entries if it is over the quota and eviction is
+// enabled.
+func (h *handler) checkQuota(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, quotaCheckTimeout)
+	defer cancel()
+
+	usage, err := h.restAPI.CacheUsage(ctx)
+	if err != nil {
+		slog.Error("error checking cache usage", "error", err)
+		return
+	}
+	slog.Debug("cache usage", "size", usage.SizeInBytes, "count", usage.Count, "limit", h.quota.limit)
+
+	h.quota.used.Store(usage.SizeInBytes)
+	if usage.SizeInBytes > h.quota.limit && h.quota.evict {
+		h.evict(ctx, usage.SizeInBytes-int64(float64(h.quota.limit)*evictTarget))
+	}
+	h.quota.known.Store(true)
+}
+
+// evict deletes the least recently used entries under the prefix until at
+// least want bytes are freed. Index and trace entries are left alone.
+func (h *handler) evict(ctx context.Context, want int64) {
+	keys, err := h.evictionCandidates(ctx)
+	if err != nil {
+		slog.Error("error listing keys for eviction", "error", err)
+		return
+	}
+
+	// The timestamps are RFC 3339 in UTC, so they sort as strings.
+	slices.SortFunc(keys, func(a, b actionscache.CacheKey) int {
+		return cmp.Or(strings.Compare(a.LastAccessed, b.LastAccessed), cmp.Compare(b.SizeInBytes, a.SizeInBytes))
+	})
+
+	var freed int64
+	var deleted int
+	for _, k := range keys {
+		if freed >= want {
+			break
+		}
+		if err := h.restAPI.DeleteCache(ctx, k.ID); err != nil {
+			slog.Error("error evicting cache entry", "key", k.Key, "error", err)
+			break
+		}
+		slog.Debug("evicted cache entry", "key", k.Key, "size", k.SizeInBytes, "lastAccessed", k.LastAccessed)
+		h.index.remove(k.Key)
+		h.indexDirty.Store(true)
+		h.lookup.forget(k.Key)
+		h.quota.used.Add(-int64(k.SizeInBytes))
+		freed += int64(k.SizeInBytes)
+		deleted++
+	}
+
+	if deleted > 0 {
+		slog.Warn(fmt.Sprintf("repository cache was over quota, evicted %d least recently used entries (%s)", deleted, formatBytes(freed)))
+	}
+}
+
+// evictionCandidates returns the keys under the prefix which may be evicted.
+// The key index is used when it was built from a full listing, as only the
+// listing has the IDs and access times eviction needs. Otherwise the keys are
+// listed again.
+func (h *handler) evictionCandidates(ctx context.Context) ([]actionscache.CacheKey, error) {
+	evictable := func(k actionscache.CacheKey) bool {
+		return !isIndexEntryKey(h.prefix, k.Key) && !isTraceKey(h.prefix, k.Key)
+	}
+
+	var keys []actionscache.CacheKey
+	if h.index.wait(ctx) && !h.indexLoaded.Load() {
+		all, _ := h.index.snapshot()
+		for _, k := range all {
+			// Keys saved by this run are not listed yet.
+			if k.ID != 0 && evictable(k) {
+				keys = append(keys, k)
+			}
+		}
+		return keys, nil
+	}
+
+	for page, err := range h.restAPI.ListKeys(ctx, h.prefix, "") {
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range page {
+			if evictable(k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// formatBytes formats n as a human readable size.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
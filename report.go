@@ -0,0 +1,383 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+const (
+	defaultStaleDays = 7
+	// reportTopN is the number of rows shown in the prefix and ref tables.
+	reportTopN = 15
+	// packRecommendEntries and packRecommendSize are the thresholds above
+	// which pack mode is recommended: many entries which are small on
+	// average.
+	packRecommendEntries = 1000
+	packRecommendSize    = 1 << 20
+	pullRequestRefs      = "refs/pull/*/merge"
+)
+
+// cacheReport aggregates the entries in the repository cache.
+type cacheReport struct {
+	Repo        string    `json:"repo"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Prefix      string    `json:"prefix"`
+
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	// Usage is the usage reported by the cache usage API, which includes
+	// entries that were not listed.
+	Usage int64 `json:"usage"`
+	Quota int64 `json:"quota"`
+
+	// Ours is the part of the cache under Prefix.
+	Ours reportBucket `json:"ours"`
+
+	Prefixes []reportBucket `json:"prefixes"`
+	Refs     []reportBucket `json:"refs"`
+	Ages     []reportBucket `json:"ages"`
+	Sizes    []reportBucket `json:"sizes"`
+
+	StaleDays  int          `json:"stale_days"`
+	Stale      reportBucket `json:"stale"`
+	StaleOurs  reportBucket `json:"stale_ours"`
+	PullOurs   reportBucket `json:"pull_request_ours"`
+	AvgOurSize int64        `json:"average_size_ours"`
+
+	Recommendations []string `json:"recommendations"`
+}
+
+// reportBucket is the number and total size of a group of entries.
+type reportBucket struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	Size    int64  `json:"size"`
+	// Other is set for the bucket combining everything outside the top
+	// buckets.
+	Other bool `json:"other,omitempty"`
+}
+
+func (b *reportBucket) add(k actionscache.CacheKey) {
+	b.Entries++
+	b.Size += int64(k.SizeInBytes)
+}
+
+// runReport implements the report command, which summarizes how the
+// repository cache is used and recommends what to prune.
+func runReport(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	prefix := defaultActionsCacheGoPrefix
+	if v, ok := os.LookupEnv(actionsCacheGoPrefix); ok {
+		prefix = v
+	}
+	quota, err := envInt(actionsCacheGoQuotaBytes, defaultQuotaBytes)
+	if err != nil {
+		return err
+	}
+	fs.StringVar(&prefix, "prefix", prefix, "`prefix` of the keys used by this tool")
+	repo := fs.String("repo", "", "`owner/name` of the repository (default $GITHUB_REPOSITORY)")
+	format := fs.String("format", "markdown", "output `format`: markdown or json")
+	staleDays := fs.Int("stale-days", defaultStaleDays, "entries not accessed for this many `days` are stale")
+	fs.Int64Var(&quota, "quota", quota, "cache size limit of the repository in `bytes`")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if *format != "markdown" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	api, err := newCommandRestAPI(*repo)
+	if err != nil {
+		return err
+	}
+
+	var keys []actionscache.CacheKey
+	for page, err := range api.ListKeys(ctx, "", "") {
+		if err != nil {
+			return fmt.Errorf("error listing keys: %w", err)
+		}
+		keys = append(keys, page...)
+	}
+
+	usage, err := api.CacheUsage(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting cache usage: %w", err)
+	}
+
+	r := buildReport(keys, prefix, *staleDays, time.Now().UTC())
+	r.Repo = api.repo
+	r.Usage = usage.SizeInBytes
+	r.Quota = quota
+	r.Recommendations = r.recommend()
+
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	return r.writeMarkdown(out)
+}
+
+// buildReport aggregates keys. Usage, quota and recommendations are filled
+// in by the caller.
+func buildReport(keys []actionscache.CacheKey, prefix string, staleDays int, now time.Time) *cacheReport {
+	r := &cacheReport{
+		GeneratedAt: now,
+		Prefix:      prefix,
+		StaleDays:   staleDays,
+		Ours:        reportBucket{Name: prefix},
+		Ages: []reportBucket{
+			{Name: "< 1 day"},
+			{Name: "1-3 days"},
+			{Name: "3-7 days"},
+			{Name: "7-30 days"},
+			{Name: "> 30 days"},
+		},
+		Sizes: []reportBucket{
+			{Name: "< 1MiB"},
+			{Name: "1-16MiB"},
+			{Name: "16-128MiB"},
+			{Name: "128MiB-1GiB"},
+			{Name: ">= 1GiB"},
+		},
+		Stale:     reportBucket{Name: fmt.Sprintf("not accessed in %d days", staleDays)},
+		StaleOurs: reportBucket{Name: fmt.Sprintf("%s not accessed in %d days", prefix, staleDays)},
+		PullOurs:  reportBucket{Name: prefix + " on " + pullRequestRefs + " not accessed in a day"},
+	}
+
+	prefixes := make(map[string]*reportBucket)
+	refs := make(map[string]*reportBucket)
+	stale := now.AddDate(0, 0, -staleDays)
+
+	for _, k := range keys {
+		r.Entries++
+		r.Size += int64(k.SizeInBytes)
+
+		ours := strings.HasPrefix(k.Key, prefix)
+		if ours {
+			r.Ours.add(k)
+		}
+
+		group := keyGroup(prefix, k.Key)
+		if prefixes[group] == nil {
+			prefixes[group] = &reportBucket{Name: group}
+		}
+		prefixes[group].add(k)
+
+		if refs[k.Ref] == nil {
+			refs[k.Ref] = &reportBucket{Name: k.Ref}
+		}
+		refs[k.Ref].add(k)
+
+		if accessed, err := time.Parse(time.RFC3339, k.LastAccessed); err == nil {
+			age := now.Sub(accessed)
+			switch {
+			case age < 24*time.Hour:
+				r.Ages[0].add(k)
+			case age < 3*24*time.Hour:
+				r.Ages[1].add(k)
+			case age < 7*24*time.Hour:
+				r.Ages[2].add(k)
+			case age < 30*24*time.Hour:
+				r.Ages[3].add(k)
+			default:
+				r.Ages[4].add(k)
+			}
+			if ours && isPullRequestRef(k.Ref) && age >= 24*time.Hour {
+				r.PullOurs.add(k)
+			}
+			if accessed.Before(stale) {
+				r.Stale.add(k)
+				if ours {
+					r.StaleOurs.add(k)
+				}
+			}
+		}
+
+		switch size := k.SizeInBytes; {
+		case size < 1<<20:
+			r.Sizes[0].add(k)
+		case size < 16<<20:
+			r.Sizes[1].add(k)
+		case size < 128<<20:
+			r.Sizes[2].add(k)
+		case size < 1<<30:
+			r.Sizes[3].add(k)
+		default:
+			r.Sizes[4].add(k)
+		}
+	}
+
+	if r.Ours.Entries > 0 {
+		r.AvgOurSize = r.Ours.Size / int64(r.Ours.Entries)
+	}
+	r.Prefixes = topBuckets(prefixes)
+	r.Refs = topBuckets(refs)
+	return r
+}
+
+// topBuckets returns the largest buckets, with the rest combined into one.
+func topBuckets(m map[string]*reportBucket) []reportBucket {
+	buckets := make([]reportBucket, 0, len(m))
+	for _, b := range m {
+		buckets = append(buckets, *b)
+	}
+	slices.SortFunc(buckets, func(a, b reportBucket) int {
+		return cmp.Or(cmp.Compare(b.Size, a.Size), strings.Compare(a.Name, b.Name))
+	})
+	if len(buckets) <= reportTopN {
+		return buckets
+	}
+
+	other := reportBucket{Name: fmt.Sprintf("%d others", len(buckets)-reportTopN), Other: true}
+	for _, b := range buckets[reportTopN:] {
+		other.Entries += b.Entries
+		other.Size += b.Size
+	}
+	return append(buckets[:reportTopN], other)
+}
+
+// keyGroup returns the part of key that is shared by related entries.
+// Keys under the prefix are grouped by kind. Other keys are cut before the
+// first component which looks like a hash, which is how actions/cache keys
+// usually end. Objects written in an older entry format are grouped under the
+// bare prefix.
+func keyGroup(prefix, key string) string {
+	switch {
+	case isIndexEntryKey(prefix, key):
+		return indexEntryKey(prefix)
+	case isTraceKey(prefix, key):
+		return prefix + traceKeyPrefix
+	case strings.HasPrefix(key, prefix+packKeyPrefix):
+		return prefix + packKeyPrefix
+	case strings.HasPrefix(key, prefix+objectKeyPrefix):
+		return prefix + objectKeyPrefix
+	case strings.HasPrefix(key, prefix):
+		return prefix
+	}
+
+	start := 0
+	for i := 0; i <= len(key); i++ {
+		if i < len(key) && !strings.ContainsRune("-_./", rune(key[i])) {
+			continue
+		}
+		if isHashLike(key[start:i]) {
+			return key[:start]
+		}
+		start = i + 1
+	}
+	return key
+}
+
+// isHashLike reports whether s looks like a hex encoded hash.
+func isHashLike(s string) bool {
+	if len(s) < 8 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isPullRequestRef(ref string) bool {
+	return strings.HasPrefix(ref, "refs/pull/") && strings.HasSuffix(ref, "/merge")
+}
+
+// recommend returns pruning recommendations, as markdown.
+func (r *cacheReport) recommend() []string {
+	command := "actions-cache-go prune"
+	if r.Prefix != defaultActionsCacheGoPrefix {
+		command += fmt.Sprintf(" -prefix '%s'", r.Prefix)
+	}
+
+	var recs []string
+	if r.StaleOurs.Entries > 0 {
+		recs = append(recs, fmt.Sprintf("%d entries (%s) under `%s` were not accessed in %d days. Delete them with `%s -accessed-before %dd`.",
+			r.StaleOurs.Entries, formatBytes(r.StaleOurs.Size), r.Prefix, r.StaleDays, command, r.StaleDays))
+	}
+	if r.PullOurs.Entries > 0 {
+		recs = append(recs, fmt.Sprintf("%d entries (%s) under `%s` belong to pull request merge refs and were not accessed in a day. Only that pull request can use them, so delete them with `%s -ref '%s' -accessed-before 1d`.",
+			r.PullOurs.Entries, formatBytes(r.PullOurs.Size), r.Prefix, command, pullRequestRefs))
+	}
+	if r.Quota > 0 && float64(r.Usage) > float64(r.Quota)*defaultQuotaShare {
+		if keep := r.Quota / 2; r.Ours.Size > keep {
+			recs = append(recs, fmt.Sprintf("The repository cache is at %d%% of its %s limit, after which GitHub evicts entries of every workflow. Keep this tool's entries to half of it with `%s -max-size %d`, or set `%s=true` to evict them automatically.",
+				r.Usage*100/r.Quota, formatBytes(r.Quota), command, keep, actionsCacheGoEvict))
+		} else {
+			recs = append(recs, fmt.Sprintf("The repository cache is at %d%% of its %s limit, after which GitHub evicts entries of every workflow. Most of it is used by other caches, see the prefix table above.",
+				r.Usage*100/r.Quota, formatBytes(r.Quota)))
+		}
+	}
+	if r.Ours.Entries >= packRecommendEntries && r.AvgOurSize < packRecommendSize {
+		recs = append(recs, fmt.Sprintf("This tool stores %d entries of %s on average. Set `%s=true` to bundle small objects into packs, which are faster to save and list.",
+			r.Ours.Entries, formatBytes(r.AvgOurSize), actionsCacheGoPack))
+	}
+	if len(recs) == 0 {
+		recs = append(recs, "Nothing to prune.")
+	}
+	return recs
+}
+
+func (r *cacheReport) writeMarkdown(out io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "## Actions cache report for %s\n\n", r.Repo)
+	fmt.Fprintf(&b, "| | Entries | Size | Share of quota |\n| --- | ---: | ---: | ---: |\n")
+	fmt.Fprintf(&b, "| Repository | %d | %s | %s |\n", r.Entries, formatBytes(r.Usage), percent(r.Usage, r.Quota))
+	fmt.Fprintf(&b, "| `%s` | %d | %s | %s |\n", r.Prefix, r.Ours.Entries, formatBytes(r.Ours.Size), percent(r.Ours.Size, r.Quota))
+	fmt.Fprintf(&b, "| %s | %d | %s | %s |\n\n", r.Stale.Name, r.Stale.Entries, formatBytes(r.Stale.Size), percent(r.Stale.Size, r.Quota))
+	fmt.Fprintf(&b, "The repository cache limit is %s.\n\n", formatBytes(r.Quota))
+
+	writeBuckets(&b, "By prefix", "Prefix", r.Prefixes, r.Size, true)
+	writeBuckets(&b, "By ref", "Ref", r.Refs, r.Size, true)
+	writeBuckets(&b, "By last access", "Last accessed", r.Ages, r.Size, false)
+	writeBuckets(&b, "By size", "Entry size", r.Sizes, r.Size, false)
+
+	b.WriteString("### Recommendations\n\n")
+	for _, rec := range r.Recommendations {
+		fmt.Fprintf(&b, "- %s\n", rec)
+	}
+
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func writeBuckets(b *strings.Builder, title, column string, buckets []reportBucket, total int64, code bool) {
+	fmt.Fprintf(b, "### %s\n\n| %s | Entries | Size | Share |\n| --- | ---: | ---: | ---: |\n", title, column)
+	for _, bucket := range buckets {
+		name := bucket.Name
+		if code && name != "" && !bucket.Other {
+			name = "`" + name + "`"
+		}
+		fmt.Fprintf(b, "| %s | %d | %s | %s |\n", name, bucket.Entries, formatBytes(bucket.Size), percent(bucket.Size, total))
+	}
+	b.WriteString("\n")
+}
+
+// percent formats n as a percentage of total.
+func percent(n, total int64) string {
+	if total <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(total))
+}
@@ -3,25 +3,42 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"iter"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	actionscache "github.com/tonistiigi/go-actions-cache"
 )
 
 const (
-	apiURL           = "https://api.github.com"
-	perPage          = 1000
+	defaultAPIURL = "https://api.github.com"
+	// defaultAPIVersion is sent in the X-GitHub-Api-Version header. Older
+	// GitHub Enterprise Server releases do not know about API versions.
+	defaultAPIVersion = "2022-11-28"
+	// perPage is the maximum page size supported by the GitHub API.
+	perPage = 100
+	// listConcurrency is the number of pages fetched in parallel.
+	listConcurrency  = 4
 	defaultUserAgent = "go-actions-cache/1.0"
 )
 
 type RestAPI struct {
-	repo  string
-	token string
-	opt   actionscache.Opt
+	baseURL string
+	repo    string
+	token   string
+	opt     actionscache.Opt
+
+	mu sync.Mutex
+	// apiVersion is the API version to request, or empty to not request
+	// one. It is cleared if the server rejects it.
+	apiVersion string
+	// rateLimit is the primary rate limit state from the last response.
+	rateLimit rateLimit
 }
 
 func optsWithDefaults(opt actionscache.Opt) actionscache.Opt {
@@ -40,12 +57,22 @@ func optsWithDefaults(opt actionscache.Opt) actionscache.Opt {
 	return opt
 }
 
-func NewRestAPI(repo, token string, opt actionscache.Opt) (*RestAPI, error) {
+// NewRestAPI creates a client for the REST API at baseURL, e.g.
+// https://api.github.com or https://HOST/api/v3 for GitHub Enterprise Server.
+// apiVersion is sent as the X-GitHub-Api-Version header unless it is empty.
+func NewRestAPI(baseURL, apiVersion, repo, token string, opt actionscache.Opt) (*RestAPI, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid API URL %q", baseURL)
+	}
+
 	opt = optsWithDefaults(opt)
 	return &RestAPI{
-		repo:  repo,
-		token: token,
-		opt:   opt,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiVersion: apiVersion,
+		repo:       repo,
+		token:      token,
+		opt:        opt,
 	}, nil
 }
 
@@ -57,42 +84,103 @@ func (r *RestAPI) httpReq(ctx context.Context, method string, url *url.URL) (*ht
 	req = req.WithContext(ctx)
 	req.Header.Set("Accept", "application/vnd.github+json")
 	req.Header.Set("Authorization", "Bearer "+r.token)
-	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("User-Agent", r.opt.UserAgent)
 	return req, nil
 }
 
+// ListKeys lists all cache keys matching prefix and ref.
+//
+// The first page is fetched to learn how many pages there are, after which the
+// remaining pages are fetched concurrently. Pages are yielded as they arrive,
+// so they are not necessarily in order.
 func (r *RestAPI) ListKeys(ctx context.Context, prefix, ref string) iter.Seq2[[]actionscache.CacheKey, error] {
-	page := 1
-
 	return func(yield func([]actionscache.CacheKey, error) bool) {
-		for {
-			keys, total, err := r.listKeysPage(ctx, prefix, ref, page)
-			if err != nil {
-				if !yield(nil, err) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		first, err := r.listKeysPage(ctx, prefix, ref, 1)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		if !yield(first.keys, nil) {
+			return
+		}
+
+		if first.lastPage <= 1 {
+			return
+		}
+
+		type result struct {
+			keys []actionscache.CacheKey
+			err  error
+		}
+
+		pages := make(chan int)
+		results := make(chan result)
+
+		var wg sync.WaitGroup
+		for range min(listConcurrency, first.lastPage-1) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for page := range pages {
+					p, err := r.listKeysPage(ctx, prefix, ref, page)
+					select {
+					case results <- result{p.keys, err}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+
+		go func() {
+			defer close(pages)
+			for page := 2; page <= first.lastPage; page++ {
+				select {
+				case pages <- page:
+				case <-ctx.Done():
 					return
 				}
 			}
+		}()
+
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
 
-			if !yield(keys, nil) {
+		for res := range results {
+			if res.err != nil {
+				yield(nil, res.err)
 				return
 			}
-
-			if total > page*perPage {
-				page++
-			} else {
-				break
+			if !yield(res.keys, nil) {
+				return
 			}
 		}
 	}
 }
 
-func (r *RestAPI) listKeysPage(ctx context.Context, prefix, ref string, page int) ([]actionscache.CacheKey, int, error) {
-	u, err := url.Parse(apiURL + "/repos/" + r.repo + "/actions/caches")
+type keysPage struct {
+	keys     []actionscache.CacheKey
+	lastPage int
+}
+
+func (r *RestAPI) listKeysPage(ctx context.Context, prefix, ref string, page int) (keysPage, error) {
+	u, err := url.Parse(r.baseURL + "/repos/" + r.repo + "/actions/caches")
 	if err != nil {
-		return nil, 0, err
+		return keysPage{}, err
 	}
 	q := u.Query()
 	q.Set("per_page", strconv.Itoa(perPage))
+	// Pages are fetched concurrently, so they must not shift while they
+	// are listed. The default order is by last access, which this process
+	// changes all the time, while new entries go last in creation order.
+	q.Set("sort", "created_at")
+	q.Set("direction", "asc")
 	if page > 0 {
 		q.Set("page", strconv.Itoa(page))
 	}
@@ -106,13 +194,14 @@ func (r *RestAPI) listKeysPage(ctx context.Context, prefix, ref string, page int
 
 	req, err := r.httpReq(ctx, "GET", u)
 	if err != nil {
-		return nil, 0, err
+		return keysPage{}, err
 	}
 
-	resp, err := r.opt.Client.Do(req)
+	resp, err := r.do(ctx, req)
 	if err != nil {
-		return nil, 0, err
+		return keysPage{}, err
 	}
+	defer resp.Body.Close()
 
 	dec := json.NewDecoder(resp.Body)
 	var keys struct {
@@ -121,9 +210,86 @@ func (r *RestAPI) listKeysPage(ctx context.Context, prefix, ref string, page int
 	}
 
 	if err := dec.Decode(&keys); err != nil {
-		return nil, 0, err
+		return keysPage{}, fmt.Errorf("error decoding cache list: %w", err)
+	}
+
+	last, ok := lastPageFromLink(resp.Header.Get("Link"))
+	if !ok {
+		last = (keys.Total + perPage - 1) / perPage
 	}
+	return keysPage{keys: keys.Caches, lastPage: last}, nil
+}
 
+// CacheUsage is the total size and number of active caches in a repository.
+type CacheUsage struct {
+	SizeInBytes int64 `json:"active_caches_size_in_bytes"`
+	Count       int   `json:"active_caches_count"`
+}
+
+// CacheUsage returns the cache usage of the repository.
+func (r *RestAPI) CacheUsage(ctx context.Context) (CacheUsage, error) {
+	u, err := url.Parse(r.baseURL + "/repos/" + r.repo + "/actions/cache/usage")
+	if err != nil {
+		return CacheUsage{}, err
+	}
+
+	req, err := r.httpReq(ctx, "GET", u)
+	if err != nil {
+		return CacheUsage{}, err
+	}
+
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		return CacheUsage{}, err
+	}
+	defer resp.Body.Close()
+
+	var usage CacheUsage
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return CacheUsage{}, fmt.Errorf("error decoding cache usage: %w", err)
+	}
+	return usage, nil
+}
+
+// DeleteCache deletes the cache entry with the given ID.
+func (r *RestAPI) DeleteCache(ctx context.Context, id int) error {
+	u, err := url.Parse(r.baseURL + "/repos/" + r.repo + "/actions/caches/" + strconv.Itoa(id))
+	if err != nil {
+		return err
+	}
+
+	req, err := r.httpReq(ctx, "DELETE", u)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		return err
+	}
 	resp.Body.Close()
-	return keys.Caches, keys.Total, nil
+	return nil
+}
+
+// lastPageFromLink extracts the page number of the "last" relation from a
+// Link header as returned by the GitHub API.
+func lastPageFromLink(header string) (int, bool) {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(link, ";")
+		if !ok || !strings.Contains(params, `rel="last"`) {
+			continue
+		}
+
+		target = strings.Trim(strings.TrimSpace(target), "<>")
+		u, err := url.Parse(target)
+		if err != nil {
+			return 0, false
+		}
+		page, err := strconv.Atoi(u.Query().Get("page"))
+		if err != nil {
+			return 0, false
+		}
+		return page, true
+	}
+	return 0, false
 }
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// standIn is a local stand-in for the GitHub REST API. It serves the cache
+// endpoints of a single repository under a base path, like GitHub Enterprise
+// Server does under /api/v3, and records the requests it gets.
+type standIn struct {
+	*httptest.Server
+	t    *testing.T
+	base string
+	// keys are the caches of the repository, in creation order.
+	keys []actionscache.CacheKey
+	// noLink leaves out the Link header, so that clients have to count
+	// pages from total_count.
+	noLink bool
+	// handle overrides the response to a request if it returns true.
+	handle func(w http.ResponseWriter, r *http.Request) bool
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newStandIn(t *testing.T, base string) *standIn {
+	s := &standIn{
+		t:    t,
+		base: base,
+		keys: []actionscache.CacheKey{
+			{ID: 1, Key: "prefix-abc", Ref: "refs/heads/main", SizeInBytes: 10},
+			{ID: 2, Key: "other-abc", Ref: "refs/heads/main", SizeInBytes: 20},
+		},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// url returns the API URL of the stand-in.
+func (s *standIn) url() string {
+	return s.Server.URL + s.base
+}
+
+func (s *standIn) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	s.mu.Unlock()
+
+	if s.handle != nil && s.handle(w, r) {
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, s.base+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, s.base) {
+	case "/repos/owner/repo/actions/caches":
+		s.listCaches(w, r)
+	case "/repos/owner/repo/actions/cache/usage":
+		json.NewEncoder(w).Encode(CacheUsage{SizeInBytes: 1234, Count: 5})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listCaches serves a page of the caches matching the key prefix and ref.
+func (s *standIn) listCaches(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("sort") != "created_at" || q.Get("direction") != "asc" {
+		s.t.Errorf("caches listed with sort=%q direction=%q, want a stable order", q.Get("sort"), q.Get("direction"))
+	}
+
+	var keys []actionscache.CacheKey
+	for _, k := range s.keys {
+		if strings.HasPrefix(k.Key, q.Get("key")) && (q.Get("ref") == "" || k.Ref == q.Get("ref")) {
+			keys = append(keys, k)
+		}
+	}
+
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if perPage == 0 {
+		perPage = 30
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	page = max(page, 1)
+	last := max((len(keys)+perPage-1)/perPage, 1)
+
+	if !s.noLink && last > 1 {
+		u := *r.URL
+		q.Set("page", strconv.Itoa(last))
+		u.RawQuery = q.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<http://%s%s>; rel="last"`, r.Host, u.String()))
+	}
+
+	start := min((page-1)*perPage, len(keys))
+	json.NewEncoder(w).Encode(map[string]any{
+		"total_count":    len(keys),
+		"actions_caches": keys[start:min(start+perPage, len(keys))],
+	})
+}
+
+// seen returns the requests the stand-in got.
+func (s *standIn) seen() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func listAll(t *testing.T, api *RestAPI, prefix string) ([]actionscache.CacheKey, error) {
+	t.Helper()
+	var keys []actionscache.CacheKey
+	for page, err := range api.ListKeys(context.Background(), prefix, "") {
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+	}
+	return keys, nil
+}
+
+func TestListKeysPages(t *testing.T) {
+	for _, noLink := range []bool{false, true} {
+		t.Run(fmt.Sprintf("noLink=%v", noLink), func(t *testing.T) {
+			srv := newStandIn(t, "")
+			srv.noLink = noLink
+			srv.keys = nil
+			for i := range 7*perPage + 3 {
+				srv.keys = append(srv.keys, actionscache.CacheKey{ID: i, Key: fmt.Sprintf("prefix-%04d", i), SizeInBytes: i})
+				if i%10 == 0 {
+					srv.keys = append(srv.keys, actionscache.CacheKey{ID: 100000 + i, Key: fmt.Sprintf("other-%04d", i)})
+				}
+			}
+
+			api, err := NewRestAPI(srv.url(), defaultAPIVersion, "owner/repo", "token", actionscache.Opt{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := listAll(t, api, "prefix-")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			seen := make(map[string]bool)
+			for _, k := range keys {
+				if seen[k.Key] {
+					t.Errorf("key %s listed twice", k.Key)
+				}
+				seen[k.Key] = true
+				if !strings.HasPrefix(k.Key, "prefix-") {
+					t.Errorf("unexpected key %s", k.Key)
+				}
+			}
+			if len(seen) != 7*perPage+3 {
+				t.Errorf("got %d keys, want %d", len(seen), 7*perPage+3)
+			}
+			if n := len(srv.seen()); n != 8 {
+				t.Errorf("got %d requests, want 8", n)
+			}
+		})
+	}
+}
+
+func TestListKeysStop(t *testing.T) {
+	srv := newStandIn(t, "")
+	srv.keys = nil
+	for i := range 5 * perPage {
+		srv.keys = append(srv.keys, actionscache.CacheKey{ID: i, Key: fmt.Sprintf("prefix-%04d", i)})
+	}
+
+	api, err := NewRestAPI(srv.url(), defaultAPIVersion, "owner/repo", "token", actionscache.Opt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping early must not leave the page workers blocked.
+	for page, err := range api.ListKeys(context.Background(), "prefix-", "") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != perPage {
+			t.Errorf("got page of %d keys, want %d", len(page), perPage)
+		}
+		break
+	}
+}
+
+func TestRestAPIEnterpriseServer(t *testing.T) {
+	srv := newStandIn(t, "/api/v3")
+
+	api, err := NewRestAPI(srv.url()+"/", defaultAPIVersion, "owner/repo", "token", actionscache.Opt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := listAll(t, api, "prefix-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Key != "prefix-abc" {
+		t.Errorf("got keys %+v, want prefix-abc", keys)
+	}
+
+	usage, err := api.CacheUsage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.SizeInBytes != 1234 || usage.Count != 5 {
+		t.Errorf("got usage %+v", usage)
+	}
+
+	for _, req := range srv.seen() {
+		if got := req.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("%s: got Authorization %q", req.URL.Path, got)
+		}
+		if got := req.Header.Get("X-GitHub-Api-Version"); got != defaultAPIVersion {
+			t.Errorf("%s: got X-GitHub-Api-Version %q, want %q", req.URL.Path, got, defaultAPIVersion)
+		}
+	}
+}
+
+func TestNewRestAPIInvalidURL(t *testing.T) {
+	for _, u := range []string{"", "api.github.com", "://x"} {
+		if _, err := NewRestAPI(u, "", "owner/repo", "token", actionscache.Opt{}); err == nil {
+			t.Errorf("NewRestAPI(%q) succeeded, want an error", u)
+		}
+	}
+}
+
+func TestNewRestAPIFromEnv(t *testing.T) {
+	runner := newStandIn(t, "/api/v3")
+	override := newStandIn(t, "/api")
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		want     *standIn
+		wantVers string
+	}{
+		{
+			name:     "runner",
+			env:      map[string]string{githubAPIURL: runner.url()},
+			want:     runner,
+			wantVers: defaultAPIVersion,
+		},
+		{
+			name: "override",
+			env: map[string]string{
+				githubAPIURL:         runner.url(),
+				actionsCacheGoAPIURL: override.url(),
+			},
+			want:     override,
+			wantVers: defaultAPIVersion,
+		},
+		{
+			name: "version",
+			env: map[string]string{
+				githubAPIURL:             runner.url(),
+				actionsCacheGoAPIVersion: "2026-03-10",
+			},
+			want:     runner,
+			wantVers: "2026-03-10",
+		},
+		{
+			name: "no version",
+			env: map[string]string{
+				githubAPIURL:             runner.url(),
+				actionsCacheGoAPIVersion: "none",
+			},
+			want: runner,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{githubAPIURL, actionsCacheGoAPIURL, actionsCacheGoAPIVersion} {
+				t.Setenv(name, tt.env[name])
+			}
+			before := len(tt.want.seen())
+
+			api, err := newRestAPIFromEnv("owner/repo", "token", http.DefaultClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := listAll(t, api, "prefix-"); err != nil {
+				t.Fatal(err)
+			}
+
+			seen := tt.want.seen()
+			if len(seen) != before+1 {
+				t.Fatalf("stand-in got %d requests, want 1", len(seen)-before)
+			}
+			if got := seen[len(seen)-1].Header.Get("X-GitHub-Api-Version"); got != tt.wantVers {
+				t.Errorf("got X-GitHub-Api-Version %q, want %q", got, tt.wantVers)
+			}
+		})
+	}
+}
+
+func TestRestAPIUnsupportedVersion(t *testing.T) {
+	srv := newStandIn(t, "/api/v3")
+	srv.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-GitHub-Api-Version") == "" {
+			return false
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Unsupported API version"})
+		return true
+	}
+
+	api, err := NewRestAPI(srv.url(), defaultAPIVersion, "owner/repo", "token", actionscache.Opt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if _, err := listAll(t, api, "prefix-"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var versions []string
+	for _, req := range srv.seen() {
+		versions = append(versions, req.Header.Get("X-GitHub-Api-Version"))
+	}
+	// Only the first request is sent with the version.
+	want := []string{defaultAPIVersion, "", ""}
+	if strings.Join(versions, ",") != strings.Join(want, ",") {
+		t.Errorf("got API versions %q, want %q", versions, want)
+	}
+}
+
+func TestRestAPIErrors(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		status  int
+		header  map[string]string
+		message string
+		delete  bool
+		want    error
+		wantMsg string
+	}{
+		{
+			name:    "unauthorized",
+			status:  http.StatusUnauthorized,
+			message: "Bad credentials",
+			want:    errRestUnauthorized,
+			wantMsg: "check that GITHUB_TOKEN is a valid token",
+		},
+		{
+			name:    "read permission",
+			status:  http.StatusForbidden,
+			message: "Resource not accessible by integration",
+			want:    errRestForbidden,
+			wantMsg: "token lacks actions:read permission for owner/repo",
+		},
+		{
+			name:    "write permission",
+			status:  http.StatusForbidden,
+			message: "Resource not accessible by integration",
+			delete:  true,
+			want:    errRestForbidden,
+			wantMsg: "token lacks actions:write permission",
+		},
+		{
+			name:    "not found",
+			status:  http.StatusNotFound,
+			message: "Not Found",
+			want:    errRestNotFound,
+			wantMsg: "repository owner/repo not found",
+		},
+		{
+			name:   "primary rate limit",
+			status: http.StatusForbidden,
+			header: map[string]string{
+				"X-RateLimit-Remaining": "0",
+				"X-RateLimit-Reset":     strconv.FormatInt(reset.Unix(), 10),
+			},
+			message: "API rate limit exceeded",
+			want:    errRestRateLimited,
+			wantMsg: "resets at " + reset.Format(time.RFC3339),
+		},
+		{
+			name:    "secondary rate limit",
+			status:  http.StatusForbidden,
+			header:  map[string]string{"Retry-After": "3600"},
+			message: "You have exceeded a secondary rate limit",
+			want:    errRestRateLimited,
+			wantMsg: "rate limit exceeded",
+		},
+		{
+			name:    "too many requests",
+			status:  http.StatusTooManyRequests,
+			header:  map[string]string{"Retry-After": "3600"},
+			want:    errRestRateLimited,
+			wantMsg: "rate limit exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newStandIn(t, "/api/v3")
+			srv.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				if tt.message != "" {
+					json.NewEncoder(w).Encode(map[string]string{"message": tt.message})
+				}
+				return true
+			}
+
+			api, err := NewRestAPI(srv.url(), defaultAPIVersion, "owner/repo", "token", actionscache.Opt{Timeout: time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.delete {
+				err = api.DeleteCache(context.Background(), 1)
+			} else {
+				_, err = listAll(t, api, "prefix-")
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("got error %q, want it to contain %q", err, tt.wantMsg)
+			}
+			if n := len(srv.seen()); n != 1 {
+				t.Errorf("got %d requests, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors returned by the REST API client, which can be checked with
+// errors.Is. The restError wrapping them carries the details.
+var (
+	errRestUnauthorized = errors.New("unauthorized")
+	errRestForbidden    = errors.New("forbidden")
+	errRestNotFound     = errors.New("not found")
+	errRestRateLimited  = errors.New("rate limited")
+)
+
+// restError is an error response from the GitHub REST API.
+type restError struct {
+	kind       error
+	statusCode int
+	message    string
+	repo       string
+	// permission is the token permission the request needs.
+	permission string
+	// resetAt is when the rate limit resets, if the request was rate limited.
+	resetAt time.Time
+	// retryAfter is how long the API asked us to wait before retrying.
+	retryAfter time.Duration
+}
+
+func (e *restError) Unwrap() error { return e.kind }
+
+func (e *restError) Error() string {
+	var msg string
+	switch e.kind {
+	case errRestUnauthorized:
+		msg = "GitHub API rejected the token, check that " + restAPIToken + " is a valid token"
+	case errRestForbidden:
+		msg = fmt.Sprintf("token lacks actions:%s permission for %s, add \"actions: %s\" to the workflow permissions", e.permission, e.repo, e.permission)
+	case errRestNotFound:
+		msg = fmt.Sprintf("repository %s not found, check %s and that the token has access to it", e.repo, githubRepo)
+	case errRestRateLimited:
+		msg = "GitHub API rate limit exceeded"
+		if !e.resetAt.IsZero() {
+			msg += ", resets at " + e.resetAt.Format(time.RFC3339)
+		}
+	default:
+		msg = "GitHub API request failed"
+	}
+	if e.message != "" {
+		msg += fmt.Sprintf(" (%d: %s)", e.statusCode, e.message)
+	} else {
+		msg += fmt.Sprintf(" (%d)", e.statusCode)
+	}
+	return msg
+}
+
+// rateLimit is the primary rate limit state reported through the
+// X-RateLimit-* headers.
+type rateLimit struct {
+	known     bool
+	remaining int
+	reset     time.Time
+}
+
+func parseRateLimit(h http.Header) (rateLimit, bool) {
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return rateLimit{}, false
+	}
+	reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return rateLimit{}, false
+	}
+	return rateLimit{known: true, remaining: remaining, reset: time.Unix(reset, 0)}, true
+}
+
+// newRestError builds the error for a non-2xx response and closes its body.
+func (r *RestAPI) newRestError(resp *http.Response) *restError {
+	defer resp.Body.Close()
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	dt, _ := io.ReadAll(io.LimitReader(resp.Body, 32*1024))
+	if json.Unmarshal(dt, &body) != nil {
+		body.Message = strings.TrimSpace(string(dt))
+	}
+
+	e := &restError{
+		statusCode: resp.StatusCode,
+		message:    body.Message,
+		repo:       r.repo,
+		permission: "read",
+	}
+	if resp.Request != nil && resp.Request.Method != http.MethodGet {
+		e.permission = "write"
+	}
+
+	retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+	rl, _ := parseRateLimit(resp.Header)
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusForbidden && (hasRetryAfter || (rl.known && rl.remaining == 0) ||
+			strings.Contains(strings.ToLower(body.Message), "rate limit")):
+		e.kind = errRestRateLimited
+		e.retryAfter = retryAfter
+		if rl.known && rl.remaining == 0 {
+			e.resetAt = rl.reset
+		}
+	case resp.StatusCode == http.StatusUnauthorized:
+		e.kind = errRestUnauthorized
+	case resp.StatusCode == http.StatusForbidden:
+		e.kind = errRestForbidden
+	case resp.StatusCode == http.StatusNotFound:
+		e.kind = errRestNotFound
+	}
+	return e
+}
+
+// retryable reports whether a request that failed with err may succeed if it
+// is retried.
+func (e *restError) retryable() bool {
+	return e.kind == errRestRateLimited || e.statusCode >= 500
+}
+
+// do sends req, retrying on rate limits and server errors until the client
+// timeout runs out. Non-2xx responses are returned as a *restError.
+func (r *RestAPI) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	deadline := time.Now().Add(r.opt.Timeout)
+
+	var lastErr error
+	for {
+		if err := r.opt.BackoffPool.Wait(ctx, time.Until(deadline)); err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+
+		// The primary rate limit is shared by every request, so there is no
+		// point in sending one that is bound to fail.
+		if wait := r.rateLimitWait(); wait > 0 {
+			if time.Now().Add(wait).After(deadline) {
+				return nil, &restError{kind: errRestRateLimited, statusCode: http.StatusForbidden, repo: r.repo, resetAt: time.Now().Add(wait)}
+			}
+			if err := sleepCtx(ctx, wait); err != nil {
+				return nil, err
+			}
+		}
+
+		attempt := req.Clone(ctx)
+		r.mu.Lock()
+		if r.apiVersion != "" {
+			attempt.Header.Set("X-GitHub-Api-Version", r.apiVersion)
+		}
+		r.mu.Unlock()
+
+		resp, err := r.opt.Client.Do(attempt)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			r.opt.BackoffPool.Delay()
+			lastErr = err
+			continue
+		}
+
+		if rl, ok := parseRateLimit(resp.Header); ok {
+			r.mu.Lock()
+			r.rateLimit = rl
+			r.mu.Unlock()
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			r.opt.BackoffPool.Reset()
+			return resp, nil
+		}
+
+		restErr := r.newRestError(resp)
+		if restErr.unsupportedAPIVersion() && r.dropAPIVersion() {
+			continue
+		}
+		if !restErr.retryable() {
+			r.opt.BackoffPool.Reset()
+			return nil, restErr
+		}
+		slog.Debug("retrying GitHub API request", "url", req.URL.Redacted(), "error", restErr)
+		lastErr = restErr
+
+		switch {
+		case restErr.retryAfter > 0:
+			if time.Now().Add(restErr.retryAfter).After(deadline) {
+				return nil, restErr
+			}
+			if err := sleepCtx(ctx, restErr.retryAfter); err != nil {
+				return nil, err
+			}
+		case restErr.resetAt.IsZero():
+			r.opt.BackoffPool.Delay()
+		}
+		// Otherwise the wait for the rate limit reset happens before the next
+		// request.
+	}
+}
+
+// unsupportedAPIVersion reports whether the request failed because the server
+// does not support the requested API version, as older GitHub Enterprise
+// Server releases do.
+func (e *restError) unsupportedAPIVersion() bool {
+	return e.statusCode == http.StatusBadRequest && strings.Contains(strings.ToLower(e.message), "api version")
+}
+
+// dropAPIVersion stops sending the API version header. It reports whether
+// one was being sent.
+func (r *RestAPI) dropAPIVersion() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.apiVersion == "" {
+		return false
+	}
+	slog.Debug("GitHub API does not support the requested API version, retrying without it", "version", r.apiVersion)
+	r.apiVersion = ""
+	return true
+}
+
+// rateLimitWait returns how long to wait for the primary rate limit to reset
+// before sending another request.
+func (r *RestAPI) rateLimitWait() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.rateLimit.known || r.rateLimit.remaining > 0 {
+		return 0
+	}
+	return max(time.Until(r.rateLimit.reset), 0)
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
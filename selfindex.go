@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// The tool maintains its own list of the keys under its prefix as a regular
+// cache entry, so that runs do not need to list every key through the REST
+// API (which is slow for large caches and needs a token with actions:read).
+//
+// The entry is a framed header (see encodeFrame) followed by a zstd
+// compressed, sorted list of keys with the prefix removed, one per line along
+// with the entry size.
+//
+// The entry is saved with [actionscache.Cache.SaveMutable], so it is stored
+// under "<prefix>index#<n>" with n increasing on every update.
+const (
+	indexEntryMagic   = "acgoindx"
+	indexEntryVersion = 1
+	// indexEntryName is appended to the configured key prefix to name the
+	// index entry.
+	indexEntryName = "index"
+
+	defaultIndexMaxAge = 24 * time.Hour
+	// indexSaveTimeout is how long to wait for a concurrent update of the
+	// index before overwriting it.
+	indexSaveTimeout = 30 * time.Second
+)
+
+type indexEntryHeader struct {
+	CreatedAt time.Time `json:"created_at"`
+	Keys      int       `json:"keys"`
+}
+
+func indexEntryKey(prefix string) string {
+	return prefix + indexEntryName
+}
+
+// isIndexEntryKey reports whether key names one of the index entries under
+// prefix.
+func isIndexEntryKey(prefix, key string) bool {
+	return strings.HasPrefix(key, indexEntryKey(prefix)+"#")
+}
+
+func encodeIndexEntry(prefix string, keys []actionscache.CacheKey) ([]byte, error) {
+	keys = slices.Clone(keys)
+	slices.SortFunc(keys, func(a, b actionscache.CacheKey) int { return strings.Compare(a.Key, b.Key) })
+
+	header, err := encodeFrame(indexEntryMagic, indexEntryVersion, indexEntryHeader{
+		CreatedAt: time.Now().UTC(),
+		Keys:      len(keys),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(header)
+	enc, err := zstd.NewWriter(buf, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		fmt.Fprintf(enc, "%s %d\n", strings.TrimPrefix(k.Key, prefix), k.SizeInBytes)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeIndexEntry(r io.Reader, prefix string) (indexEntryHeader, []actionscache.CacheKey, error) {
+	var hdr indexEntryHeader
+
+	version, _, err := readFrame(r, indexEntryMagic, &hdr)
+	if err != nil {
+		return hdr, nil, err
+	}
+	if version != indexEntryVersion {
+		return hdr, nil, fmt.Errorf("unsupported index version %d", version)
+	}
+
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return hdr, nil, err
+	}
+	defer dec.Close()
+
+	keys := make([]actionscache.CacheKey, 0, hdr.Keys)
+	scanner := bufio.NewScanner(dec)
+	for scanner.Scan() {
+		key, size, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return hdr, nil, fmt.Errorf("invalid index line %q", scanner.Text())
+		}
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return hdr, nil, fmt.Errorf("invalid index line %q", scanner.Text())
+		}
+		keys = append(keys, actionscache.CacheKey{Key: prefix + key, SizeInBytes: n})
+	}
+	if err := scanner.Err(); err != nil {
+		return hdr, nil, err
+	}
+	return hdr, keys, nil
+}
+
+// readIndexEntry downloads and decodes an index entry.
+func (h *handler) readIndexEntry(ctx context.Context, entry *actionscache.Entry) (indexEntryHeader, []actionscache.CacheKey, error) {
+	remote := entry.Download(ctx)
+	defer remote.Close()
+	return decodeIndexEntry(io.NewSectionReader(remote, 0, math.MaxInt64), h.prefix)
+}
+
+// loadIndexEntry loads the latest index entry.
+// It returns false if there is no index, or if it is older than the maximum
+// age.
+func (h *handler) loadIndexEntry(ctx context.Context) ([]actionscache.CacheKey, bool) {
+	entry, err := h.client.Load(ctx, indexEntryKey(h.prefix)+"#")
+	if err != nil {
+		slog.Error("error loading key index", "error", err)
+		return nil, false
+	}
+	if entry == nil || !isIndexEntryKey(h.prefix, entry.Key) {
+		slog.Debug("no key index found")
+		return nil, false
+	}
+
+	hdr, keys, err := h.readIndexEntry(ctx, entry)
+	if err != nil {
+		slog.Error("error reading key index", "key", entry.Key, "error", err)
+		return nil, false
+	}
+
+	if age := time.Since(hdr.CreatedAt); age > h.indexMaxAge {
+		slog.Debug("key index is stale", "key", entry.Key, "age", age)
+		return nil, false
+	}
+
+	slog.Debug("loaded key index", "key", entry.Key, "keys", len(keys), "created", hdr.CreatedAt)
+	return keys, true
+}
+
+// publishIndexEntry saves the current key index, merged with the latest
+// published index, so that the next run can use it.
+// If the key index was built from a REST listing, the listing is
+// authoritative: the published index is only merged in if it was saved after
+// the listing started, so that keys evicted by GitHub are dropped.
+// Nothing is saved if no keys were added or removed during this run, or if
+// the key index is not complete by the time ctx is done, since the published
+// index is trusted to contain every key.
+func (h *handler) publishIndexEntry(ctx context.Context) error {
+	if !h.indexDirty.Load() {
+		return nil
+	}
+	if !h.index.wait(ctx) {
+		slog.Debug("key index is incomplete, not publishing it")
+		return nil
+	}
+
+	keys, removed := h.index.snapshot()
+
+	err := h.client.SaveMutable(ctx, indexEntryKey(h.prefix), indexSaveTimeout, func(old *actionscache.Entry) (actionscache.Blob, error) {
+		merged := make(map[string]actionscache.CacheKey, len(keys))
+		if old != nil {
+			hdr, oldKeys, err := h.readIndexEntry(ctx, old)
+			if err != nil {
+				slog.Debug("ignoring unreadable key index", "key", old.Key, "error", err)
+			}
+			if !h.indexLoaded.Load() && hdr.CreatedAt.Before(h.indexListed) {
+				slog.Debug("replacing key index older than the key listing", "key", old.Key, "created", hdr.CreatedAt)
+				oldKeys = nil
+			}
+			for _, k := range oldKeys {
+				merged[k.Key] = k
+			}
+		}
+		for _, k := range keys {
+			merged[k.Key] = k
+		}
+
+		out := make([]actionscache.CacheKey, 0, len(merged))
+		for _, k := range merged {
+			if _, ok := removed[k.Key]; ok || isIndexEntryKey(h.prefix, k.Key) {
+				continue
+			}
+			out = append(out, k)
+		}
+
+		dt, err := encodeIndexEntry(h.prefix, out)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("publishing key index", "keys", len(out), "size", len(dt))
+		return actionscache.NewBlob(dt), nil
+	})
+	if err != nil {
+		return fmt.Errorf("error saving key index: %w", err)
+	}
+	return nil
+}
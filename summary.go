@@ -0,0 +1,264 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+)
+
+// The summary covers everything the cache did for a job, however many
+// processes that took. The daemon keeps the numbers itself and hands them to
+// the flush client, which writes them with the environment of its own step.
+// Without a daemon, every process saves its numbers in the summary directory
+// when it exits, and flush adds them all up.
+const (
+	summaryDirName = "summaries"
+
+	githubRunAttempt = "GITHUB_RUN_ATTEMPT"
+	githubJob        = "GITHUB_JOB"
+
+	// staleSummaryAge is how old summaries of other runs get before they are
+	// removed.
+	staleSummaryAge = 24 * time.Hour
+)
+
+// runSummary holds the headline numbers of a run, which are reported in the
+// job summary and as step outputs.
+type runSummary struct {
+	LocalHits  int64 `json:"local_hits"`
+	RemoteHits int64 `json:"remote_hits"`
+	Misses     int64 `json:"misses"`
+
+	DownloadBytes int64 `json:"download_bytes"`
+	UploadBytes   int64 `json:"upload_bytes"`
+
+	UploadsDone      int   `json:"uploads_done"`
+	UploadsSkipped   int   `json:"uploads_skipped"`
+	UploadsFailed    int   `json:"uploads_failed"`
+	UploadsPending   int   `json:"uploads_pending"`
+	UploadsOverQuota int64 `json:"uploads_over_quota"`
+	UploadConflicts  int64 `json:"upload_conflicts"`
+	PacksSaved       int64 `json:"packs_saved"`
+	PacksFailed      int64 `json:"packs_failed"`
+
+	InitKeys  time.Duration `json:"init_keys"`
+	IndexWait time.Duration `json:"index_wait"`
+	// Slowest holds the slowest remote operations, with the keys relative to
+	// the prefix.
+	Slowest []remoteOp `json:"slowest,omitempty"`
+}
+
+func (h *handler) runSummary() runSummary {
+	m := h.metrics
+	counts := h.uploads.counts()
+	slowest := m.slowest.list()
+	for i := range slowest {
+		slowest[i].Key = strings.TrimPrefix(slowest[i].Key, h.prefix)
+	}
+	return runSummary{
+		LocalHits:        m.localHits.Value(),
+		RemoteHits:       m.remoteHits.Value(),
+		Misses:           m.misses.Value(),
+		DownloadBytes:    m.downloadBytes.Value(),
+		UploadBytes:      m.uploadBytes.Value(),
+		UploadsDone:      counts[uploadDone],
+		UploadsSkipped:   counts[uploadSkipped],
+		UploadsFailed:    counts[uploadFailed],
+		UploadsPending:   counts[uploadQueued] + counts[uploadRunning],
+		UploadsOverQuota: h.quota.blocked.Load(),
+		UploadConflicts:  m.uploadConflicts.Value(),
+		PacksSaved:       m.packsSaved.Value(),
+		PacksFailed:      m.packsFailed.Value(),
+		InitKeys:         time.Duration(m.initKeysSeconds.Value() * float64(time.Second)),
+		IndexWait:        time.Duration(m.indexWaitSeconds.Value() * float64(time.Second)),
+		Slowest:          slowest,
+	}
+}
+
+func (s runSummary) gets() int64 {
+	return s.LocalHits + s.RemoteHits + s.Misses
+}
+
+func (s runSummary) uploads() int {
+	return s.UploadsDone + s.UploadsSkipped + s.UploadsFailed + s.UploadsPending
+}
+
+// empty reports whether the run did not use the cache, e.g. for go env.
+func (s runSummary) empty() bool {
+	return s.gets() == 0 && s.uploads() == 0 && s.PacksSaved+s.PacksFailed == 0
+}
+
+// hitRate returns the share of gets that were hits, in percent.
+func (s runSummary) hitRate() float64 {
+	if s.gets() == 0 {
+		return 0
+	}
+	return float64(s.LocalHits+s.RemoteHits) * 100 / float64(s.gets())
+}
+
+// merge adds the numbers of another process of the same run.
+func (s *runSummary) merge(o runSummary) {
+	s.LocalHits += o.LocalHits
+	s.RemoteHits += o.RemoteHits
+	s.Misses += o.Misses
+	s.DownloadBytes += o.DownloadBytes
+	s.UploadBytes += o.UploadBytes
+	s.UploadsDone += o.UploadsDone
+	s.UploadsSkipped += o.UploadsSkipped
+	s.UploadsFailed += o.UploadsFailed
+	s.UploadsPending += o.UploadsPending
+	s.UploadsOverQuota += o.UploadsOverQuota
+	s.UploadConflicts += o.UploadConflicts
+	s.PacksSaved += o.PacksSaved
+	s.PacksFailed += o.PacksFailed
+	s.InitKeys += o.InitKeys
+	s.IndexWait += o.IndexWait
+
+	s.Slowest = append(s.Slowest, o.Slowest...)
+	slices.SortStableFunc(s.Slowest, func(a, b remoteOp) int {
+		return cmp.Compare(b.Duration, a.Duration)
+	})
+	s.Slowest = s.Slowest[:min(len(s.Slowest), slowOpsKept)]
+}
+
+// report appends the summary to the job summary and sets the headline
+// numbers as step outputs.
+func (s runSummary) report() {
+	if err := appendStepSummary(s.markdown()); err != nil {
+		slog.Error("error writing job summary", "error", err)
+	}
+
+	err := setStepOutputs([]stepOutput{
+		{"hit_rate", strconv.FormatFloat(s.hitRate(), 'f', 1, 64)},
+		{"local_hits", strconv.FormatInt(s.LocalHits, 10)},
+		{"remote_hits", strconv.FormatInt(s.RemoteHits, 10)},
+		{"misses", strconv.FormatInt(s.Misses, 10)},
+		{"download_bytes", strconv.FormatInt(s.DownloadBytes, 10)},
+		{"upload_bytes", strconv.FormatInt(s.UploadBytes, 10)},
+		{"uploads_done", strconv.Itoa(s.UploadsDone)},
+		{"uploads_failed", strconv.Itoa(s.UploadsFailed)},
+	})
+	if err != nil {
+		slog.Error("error writing step outputs", "error", err)
+	}
+}
+
+// runKey identifies the job a summary belongs to.
+func runKey() string {
+	id := os.Getenv(githubRunID)
+	if id == "" {
+		return "local"
+	}
+	return fmt.Sprintf("%s-%s-%s", id, os.Getenv(githubRunAttempt), os.Getenv(githubJob))
+}
+
+// saveRunSummary saves the numbers of this process for flush to report.
+// Processes which did not use the cache are left out.
+func (h *handler) saveRunSummary(cacheDirPath string) {
+	s := h.runSummary()
+	if s.empty() {
+		return
+	}
+
+	dir := filepath.Join(cacheDirPath, summaryDirName)
+	err := os.MkdirAll(dir, 0755)
+	var dt []byte
+	if err == nil {
+		dt, err = json.Marshal(s)
+	}
+	if err == nil {
+		name := fmt.Sprintf("%s.%d.%d.json", runKey(), os.Getpid(), time.Now().UnixNano())
+		err = atomicfile.WriteData(filepath.Join(dir, name), dt, 0644)
+	}
+	if err != nil {
+		slog.Error("error saving run summary", "error", err)
+	}
+}
+
+// takeRunSummaries adds up and removes the summaries saved by the processes
+// of this run.
+func takeRunSummaries(cacheDirPath string) (runSummary, error) {
+	var total runSummary
+	dir := filepath.Join(cacheDirPath, summaryDirName)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return total, nil
+		}
+		return total, err
+	}
+
+	prefix := runKey() + "."
+	for _, f := range files {
+		p := filepath.Join(dir, f.Name())
+		if !strings.HasPrefix(f.Name(), prefix) || !strings.HasSuffix(f.Name(), ".json") {
+			// Another run's, or a leftover temp file.
+			if info, err := f.Info(); err == nil && time.Since(info.ModTime()) > staleSummaryAge {
+				os.Remove(p)
+			}
+			continue
+		}
+
+		dt, err := os.ReadFile(p)
+		if err != nil {
+			return total, err
+		}
+		var s runSummary
+		if err := json.Unmarshal(dt, &s); err != nil {
+			slog.Debug("ignoring invalid run summary", "path", p, "error", err)
+		} else {
+			total.merge(s)
+		}
+		os.Remove(p)
+	}
+	return total, nil
+}
+
+func (s runSummary) markdown() string {
+	var b strings.Builder
+	gets := s.gets()
+
+	b.WriteString("### Go build cache\n\n")
+	fmt.Fprintf(&b, "%d gets, %.1f%% hit rate.\n\n", gets, s.hitRate())
+	b.WriteString("| | Gets | Share |\n| --- | ---: | ---: |\n")
+	fmt.Fprintf(&b, "| Local hits | %d | %s |\n", s.LocalHits, percent(s.LocalHits, gets))
+	fmt.Fprintf(&b, "| Remote hits | %d | %s |\n", s.RemoteHits, percent(s.RemoteHits, gets))
+	fmt.Fprintf(&b, "| Misses | %d | %s |\n\n", s.Misses, percent(s.Misses, gets))
+
+	fmt.Fprintf(&b, "Downloaded %s and uploaded %s.\n\n", formatBytes(s.DownloadBytes), formatBytes(s.UploadBytes))
+
+	if s.uploads() > 0 {
+		fmt.Fprintf(&b, "Uploads: %d saved, %d already cached (%d conflicts), %d failed", s.UploadsDone, s.UploadsSkipped, s.UploadConflicts, s.UploadsFailed)
+		if s.UploadsPending > 0 {
+			fmt.Fprintf(&b, ", %d left for the next run", s.UploadsPending)
+		}
+		if s.UploadsOverQuota > 0 {
+			fmt.Fprintf(&b, ", %d held back by the cache quota", s.UploadsOverQuota)
+		}
+		b.WriteString(".\n\n")
+	}
+	if s.PacksSaved+s.PacksFailed > 0 {
+		fmt.Fprintf(&b, "Packs: %d saved, %d failed.\n\n", s.PacksSaved, s.PacksFailed)
+	}
+
+	fmt.Fprintf(&b, "Loading the key list took %s, gets waited %s for it in total.\n\n", s.InitKeys.Round(time.Millisecond), s.IndexWait.Round(time.Millisecond))
+
+	if len(s.Slowest) > 0 {
+		b.WriteString("| Slowest remote operations | Key | Duration |\n| --- | --- | ---: |\n")
+		for _, op := range s.Slowest {
+			fmt.Fprintf(&b, "| %s | `%s` | %s |\n", op.Op, op.Key, op.Duration.Round(time.Millisecond))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
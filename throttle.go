@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+const (
+	defaultRemoteConcurrency = 16
+	// A throttled request halves the concurrency limit at most once per
+	// decreaseCooldown, so that a burst of throttled requests which were
+	// already in flight counts as one event.
+	decreaseCooldown = 2 * time.Second
+	// maxRetryAfter caps how long a Retry-After header can pause requests.
+	maxRetryAfter = 2 * time.Minute
+)
+
+// errorClass is a coarse classification of remote errors.
+type errorClass int
+
+const (
+	errorNone errorClass = iota
+	// errorThrottled means the service asked us to slow down.
+	errorThrottled
+	// errorTransient means the operation may succeed if it is retried.
+	errorTransient
+	// errorPermanent means retrying will not help.
+	errorPermanent
+	// errorConflict means the entry already exists.
+	errorConflict
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errorNone:
+		return "none"
+	case errorThrottled:
+		return "throttled"
+	case errorTransient:
+		return "transient"
+	case errorPermanent:
+		return "permanent"
+	case errorConflict:
+		return "conflict"
+	default:
+		return fmt.Sprintf("errorClass(%d)", int(c))
+	}
+}
+
+// classifyError classifies an error returned by a remote operation.
+func classifyError(err error) errorClass {
+	if err == nil {
+		return errorNone
+	}
+
+	var he actionscache.HTTPError
+	if errors.As(err, &he) {
+		switch {
+		case he.StatusCode == http.StatusTooManyRequests:
+			return errorThrottled
+		case he.StatusCode == http.StatusConflict:
+			return errorConflict
+		case he.StatusCode == http.StatusRequestTimeout || he.StatusCode >= 500:
+			return errorTransient
+		default:
+			return errorPermanent
+		}
+	}
+
+	var ne net.Error
+	switch {
+	case errors.Is(err, errVerify):
+		return errorPermanent
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, errStalled),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &ne):
+		return errorTransient
+	default:
+		return errorPermanent
+	}
+}
+
+// concurrencyController limits the number of concurrent remote operations,
+// shared between gets and puts. The limit grows by about one for every
+// limit successful operations and is halved when the service throttles us
+// (additive increase, multiplicative decrease).
+type concurrencyController struct {
+	max float64
+
+	mu           sync.Mutex
+	limit        float64
+	inUse        int
+	lastDecrease time.Time
+	// changed is closed and replaced whenever a slot may have become free.
+	changed chan struct{}
+}
+
+func newConcurrencyController(limit int) *concurrencyController {
+	return &concurrencyController{
+		max:     float64(limit),
+		limit:   float64(limit),
+		changed: make(chan struct{}),
+	}
+}
+
+// notify wakes up waiters. The caller must hold c.mu.
+func (c *concurrencyController) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// acquire waits for a free slot. Every successful call must be followed by a
+// call to release.
+func (c *concurrencyController) acquire(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		if c.inUse < int(c.limit) {
+			c.inUse++
+			c.mu.Unlock()
+			return nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// release frees a slot and adjusts the limit based on the outcome of the
+// operation.
+func (c *concurrencyController) release(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inUse--
+	switch classifyError(err) {
+	case errorNone, errorConflict:
+		c.limit = min(c.max, c.limit+1/c.limit)
+	case errorThrottled:
+		c.decrease()
+	}
+	c.notify()
+}
+
+// throttled records that the service throttled a request.
+func (c *concurrencyController) throttled() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.decrease()
+}
+
+// decrease halves the limit. The caller must hold c.mu.
+func (c *concurrencyController) decrease() {
+	if time.Since(c.lastDecrease) < decreaseCooldown {
+		return
+	}
+	c.lastDecrease = time.Now()
+	c.limit = max(1, c.limit/2)
+	slog.Debug("remote cache is throttling requests, lowering concurrency", "limit", int(c.limit))
+}
+
+func (c *concurrencyController) currentLimit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.limit)
+}
+
+// throttleTransport watches responses for throttling. It tells the
+// concurrency controller about it, and holds back further requests to the
+// same host for as long as the service asks with Retry-After.
+type throttleTransport struct {
+	base http.RoundTripper
+	ctrl *concurrencyController // nil to only honor Retry-After
+
+	mu         sync.Mutex
+	pauseUntil map[string]time.Time // by host
+
+	// throttled counts throttled responses.
+	throttled atomic.Int64
+}
+
+func newThrottleTransport(base http.RoundTripper, ctrl *concurrencyController) *throttleTransport {
+	return &throttleTransport{
+		base:       base,
+		ctrl:       ctrl,
+		pauseUntil: make(map[string]time.Time),
+	}
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	until := t.pauseUntil[req.URL.Host]
+	t.mu.Unlock()
+
+	if d := time.Until(until); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode == http.StatusServiceUnavailable && hasRetryAfter) {
+		t.throttled.Add(1)
+		if t.ctrl != nil {
+			t.ctrl.throttled()
+		}
+	}
+	if hasRetryAfter && resp.StatusCode >= 400 {
+		until := time.Now().Add(min(retryAfter, maxRetryAfter))
+		t.mu.Lock()
+		if until.After(t.pauseUntil[req.URL.Host]) {
+			t.pauseUntil[req.URL.Host] = until
+		}
+		t.mu.Unlock()
+		slog.Debug("remote service asked to retry later", "host", req.URL.Host, "retryAfter", retryAfter)
+	}
+	return resp, nil
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// logSummary reports how often the remote service throttled us.
+func (t *throttleTransport) logSummary() {
+	n := t.throttled.Load()
+	if n == 0 {
+		return
+	}
+	slog.Info("remote cache throttling", "throttledRequests", n, "concurrencyLimit", t.ctrl.currentLimit())
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+	"golang.org/x/sync/errgroup"
+)
+
+// An access trace lists the action IDs a run used, so that the next run on
+// the same ref can download them before the go command asks for them.
+//
+// The trace is stored like the key index (see selfindex.go): a framed header
+// followed by a zstd compressed, sorted list of action IDs with the prefix
+// removed, one per line. It is saved with SaveMutable under
+// "<prefix>trace-<ref>#<n>".
+//
+// Every go command is its own process unless daemon mode is used, so the
+// trace saved by a command is merged with the one saved earlier in the same
+// workflow run.
+const (
+	traceMagic   = "acgotrce"
+	traceVersion = 1
+	// traceKeyPrefix is appended to the configured key prefix to name traces.
+	traceKeyPrefix = "trace-"
+
+	githubBaseRef = "GITHUB_BASE_REF"
+	githubRunID   = "GITHUB_RUN_ID"
+)
+
+type traceHeader struct {
+	CreatedAt time.Time `json:"created_at"`
+	Ref       string    `json:"ref"`
+	// RunID is the workflow run which saved the trace.
+	RunID   string `json:"run_id,omitempty"`
+	Actions int    `json:"actions"`
+}
+
+// accessTrace records the action IDs used during a run and keeps track of
+// how well the trace of the previous run predicted them.
+// A nil *accessTrace records nothing.
+type accessTrace struct {
+	// refs are the refs to load a previous trace from, in order of
+	// preference. The trace is saved for the first one.
+	refs []string
+	// runID is the current workflow run.
+	runID string
+
+	mu        sync.Mutex
+	gets      map[string]bool // action ID -> hit
+	puts      map[string]struct{}
+	predicted map[string]struct{}
+}
+
+// newAccessTrace returns a trace for the current ref. It returns nil if the
+// ref is not known.
+// Pull requests fall back to the trace of their base branch.
+func newAccessTrace() *accessTrace {
+	ref := os.Getenv(githubRef)
+	if ref == "" {
+		return nil
+	}
+
+	refs := []string{ref}
+	if base := os.Getenv(githubBaseRef); base != "" {
+		refs = append(refs, "refs/heads/"+base)
+	}
+
+	return &accessTrace{
+		refs:      refs,
+		runID:     os.Getenv(githubRunID),
+		gets:      make(map[string]bool),
+		puts:      make(map[string]struct{}),
+		predicted: make(map[string]struct{}),
+	}
+}
+
+// recordGet records a get for actionID and whether it was a hit.
+func (t *accessTrace) recordGet(actionID string, hit bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.gets[actionID] = t.gets[actionID] || hit
+}
+
+// recordPut records an object that was uploaded, which the next run can
+// expect to hit.
+func (t *accessTrace) recordPut(actionID string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.puts[actionID] = struct{}{}
+}
+
+func (t *accessTrace) setPredicted(actionIDs []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, id := range actionIDs {
+		t.predicted[id] = struct{}{}
+	}
+}
+
+// actionIDs returns the action IDs the next run is expected to use: every
+// hit and every upload.
+func (t *accessTrace) actionIDs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]string, 0, len(t.gets)+len(t.puts))
+	for id, hit := range t.gets {
+		if hit {
+			ids = append(ids, id)
+		}
+	}
+	for id := range t.puts {
+		if hit := t.gets[id]; !hit {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// traceStats compares the gets of this run with the previous trace.
+type traceStats struct {
+	predicted         int
+	unused            int
+	predictedHits     int
+	predictedMisses   int
+	unpredictedHits   int
+	unpredictedMisses int
+}
+
+// stats reports how many gets were predicted by the previous trace.
+func (t *accessTrace) stats() traceStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := traceStats{predicted: len(t.predicted)}
+	for id, hit := range t.gets {
+		_, predicted := t.predicted[id]
+		switch {
+		case predicted && hit:
+			s.predictedHits++
+		case predicted:
+			s.predictedMisses++
+		case hit:
+			s.unpredictedHits++
+		default:
+			s.unpredictedMisses++
+		}
+	}
+	s.unused = s.predicted - s.predictedHits - s.predictedMisses
+	return s
+}
+
+// logStats logs the stats of the trace.
+func (t *accessTrace) logStats() {
+	if t == nil {
+		return
+	}
+	s := t.stats()
+	slog.Info("access trace",
+		"predicted", s.predicted,
+		"unused", s.unused,
+		"predictedHits", s.predictedHits,
+		"predictedMisses", s.predictedMisses,
+		"unpredictedHits", s.unpredictedHits,
+		"unpredictedMisses", s.unpredictedMisses,
+	)
+}
+
+// traceKey returns the key a trace for ref is stored under.
+// Commas are not allowed in cache keys.
+func (h *handler) traceKey(ref string) string {
+	return h.prefix + traceKeyPrefix + strings.ReplaceAll(ref, ",", "_")
+}
+
+// isTraceKey reports whether key names an access trace under prefix.
+func isTraceKey(prefix, key string) bool {
+	return strings.HasPrefix(key, prefix+traceKeyPrefix)
+}
+
+func encodeTrace(prefix, ref, runID string, actionIDs []string) ([]byte, error) {
+	actionIDs = slices.Clone(actionIDs)
+	slices.Sort(actionIDs)
+
+	header, err := encodeFrame(traceMagic, traceVersion, traceHeader{
+		CreatedAt: time.Now().UTC(),
+		Ref:       ref,
+		RunID:     runID,
+		Actions:   len(actionIDs),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(header)
+	enc, err := zstd.NewWriter(buf, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range actionIDs {
+		fmt.Fprintln(enc, strings.TrimPrefix(id, prefix))
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeTrace(r io.Reader, prefix string) (traceHeader, []string, error) {
+	var hdr traceHeader
+
+	version, _, err := readFrame(r, traceMagic, &hdr)
+	if err != nil {
+		return hdr, nil, err
+	}
+	if version != traceVersion {
+		return hdr, nil, fmt.Errorf("unsupported trace version %d", version)
+	}
+
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return hdr, nil, err
+	}
+	defer dec.Close()
+
+	ids := make([]string, 0, hdr.Actions)
+	scanner := bufio.NewScanner(dec)
+	for scanner.Scan() {
+		if id := scanner.Text(); id != "" {
+			ids = append(ids, prefix+id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return hdr, nil, err
+	}
+	return hdr, ids, nil
+}
+
+// readTrace downloads and decodes a trace.
+func (h *handler) readTrace(ctx context.Context, entry *actionscache.Entry) (traceHeader, []string, error) {
+	remote := entry.Download(ctx)
+	defer remote.Close()
+	return decodeTrace(io.NewSectionReader(remote, 0, math.MaxInt64), h.prefix)
+}
+
+// loadTrace loads the latest trace saved for one of the trace refs.
+func (h *handler) loadTrace(ctx context.Context) []string {
+	for _, ref := range h.trace.refs {
+		key := h.traceKey(ref)
+		entry, err := h.client.Load(ctx, key+"#")
+		if err != nil {
+			slog.Error("error loading access trace", "key", key, "error", err)
+			return nil
+		}
+		if entry == nil || !strings.HasPrefix(entry.Key, key+"#") {
+			continue
+		}
+
+		hdr, ids, err := h.readTrace(ctx, entry)
+		if err != nil {
+			slog.Error("error reading access trace", "key", entry.Key, "error", err)
+			return nil
+		}
+
+		slog.Debug("loaded access trace", "key", entry.Key, "actions", len(ids), "created", hdr.CreatedAt)
+		return ids
+	}
+
+	slog.Debug("no access trace found")
+	return nil
+}
+
+// prefetchTrace downloads every object listed in the trace of the previous
+// run.
+func (h *handler) prefetchTrace(ctx context.Context) {
+	ids := h.loadTrace(ctx)
+	if len(ids) == 0 {
+		return
+	}
+	h.trace.setPredicted(ids)
+
+	start := time.Now()
+
+	var eg errgroup.Group
+	eg.SetLimit(h.prefetchConcurrency)
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			if _, err := h.get(ctx, id); err != nil && ctx.Err() == nil {
+				slog.Debug("error prefetching traced cache key", "actionID", id, "error", err)
+			}
+			return nil
+		})
+	}
+	eg.Wait()
+
+	slog.Debug("trace prefetch finished", "actions", len(ids), "duration", time.Since(start))
+}
+
+// publishTrace saves the action IDs used during this run for the next run on
+// the same ref. The trace saved by an earlier command of the same workflow
+// run is merged in, a trace of another run is replaced.
+func (h *handler) publishTrace(ctx context.Context) error {
+	ids := h.trace.actionIDs()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ref, runID := h.trace.refs[0], h.trace.runID
+	err := h.client.SaveMutable(ctx, h.traceKey(ref), indexSaveTimeout, func(old *actionscache.Entry) (actionscache.Blob, error) {
+		merged := ids
+		if old != nil && runID != "" {
+			hdr, oldIDs, err := h.readTrace(ctx, old)
+			if err != nil {
+				slog.Debug("ignoring unreadable access trace", "key", old.Key, "error", err)
+			} else if hdr.RunID == runID {
+				merged = slices.Concat(ids, oldIDs)
+				slices.Sort(merged)
+				merged = slices.Compact(merged)
+			}
+		}
+
+		dt, err := encodeTrace(h.prefix, ref, runID, merged)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("publishing access trace", "ref", ref, "actions", len(merged), "size", len(dt))
+		return actionscache.NewBlob(dt), nil
+	})
+	if err != nil {
+		return fmt.Errorf("error saving access trace: %w", err)
+	}
+	return nil
+}
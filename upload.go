@@ -0,0 +1,312 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultUploadConcurrency = 8
+	defaultUploadMaxBytes    = 512 << 20
+)
+
+// uploadState is the state of an upload task.
+type uploadState int
+
+const (
+	uploadQueued uploadState = iota
+	uploadRunning
+	// uploadDone means the object was saved to the remote cache.
+	uploadDone
+	// uploadSkipped means the object already existed in the remote cache.
+	uploadSkipped
+	uploadFailed
+)
+
+func (s uploadState) String() string {
+	switch s {
+	case uploadQueued:
+		return "queued"
+	case uploadRunning:
+		return "running"
+	case uploadDone:
+		return "done"
+	case uploadSkipped:
+		return "skipped"
+	case uploadFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("uploadState(%d)", int(s))
+	}
+}
+
+// uploadTask is an object waiting to be, or being, uploaded.
+type uploadTask struct {
+	actionID string
+	outputID string
+	size     int64
+	path     string
+
+	// state and err are guarded by uploader.mu.
+	state uploadState
+	err   error
+}
+
+// uploader schedules uploads to the remote cache.
+//
+// Uploads run on a fixed number of workers, smallest objects first, with a
+// cap on the total size of the objects being uploaded at once. They use a
+// context that lives as long as the server rather than the request that put
+// the object, so they are not canceled when a request finishes.
+type uploader struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	run         func(context.Context, *uploadTask) (uploadState, error)
+	concurrency int
+	maxBytes    int64
+
+	mu sync.Mutex
+	// cond is signaled whenever the queue or the running tasks change.
+	cond          *sync.Cond
+	queue         uploadQueue
+	tasks         map[string]*uploadTask
+	running       int
+	runningBytes  int64
+	closed        bool
+	workersActive sync.WaitGroup
+}
+
+// newUploader starts an uploader which uploads tasks with run.
+func newUploader(ctx context.Context, concurrency int, maxBytes int64, run func(context.Context, *uploadTask) (uploadState, error)) *uploader {
+	ctx, cancel := context.WithCancel(ctx)
+	u := &uploader{
+		ctx:         ctx,
+		cancel:      cancel,
+		run:         run,
+		concurrency: concurrency,
+		maxBytes:    maxBytes,
+		tasks:       make(map[string]*uploadTask),
+	}
+	u.cond = sync.NewCond(&u.mu)
+
+	u.workersActive.Add(concurrency)
+	for range concurrency {
+		go u.worker()
+	}
+	context.AfterFunc(ctx, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.cond.Broadcast()
+	})
+	return u
+}
+
+// Errors returned by enqueue for tasks it does not queue.
+var (
+	errUploadsClosed   = errors.New("uploader is closed")
+	errUploadScheduled = errors.New("upload already queued or running")
+	errUploadDone      = errors.New("object already uploaded")
+)
+
+// enqueue schedules an upload. Objects which are already queued, being
+// uploaded, or were uploaded successfully are ignored, and so is everything
+// once the uploader is closed.
+func (u *uploader) enqueue(t *uploadTask) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return errUploadsClosed
+	}
+	if prev, ok := u.tasks[t.actionID]; ok {
+		switch prev.state {
+		case uploadQueued, uploadRunning:
+			return errUploadScheduled
+		case uploadDone, uploadSkipped:
+			return errUploadDone
+		}
+	}
+
+	t.state = uploadQueued
+	t.err = nil
+	u.tasks[t.actionID] = t
+	heap.Push(&u.queue, t)
+	u.cond.Broadcast()
+	return nil
+}
+
+// next waits for a task that can be started. It returns nil when the
+// uploader is closed and the queue is drained, or the context is canceled.
+func (u *uploader) next() *uploadTask {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for {
+		if u.ctx.Err() != nil {
+			return nil
+		}
+		if len(u.queue) > 0 {
+			t := u.queue[0]
+			// An object larger than the cap can still go on its own.
+			if u.runningBytes == 0 || u.runningBytes+t.size <= u.maxBytes {
+				heap.Pop(&u.queue)
+				t.state = uploadRunning
+				u.running++
+				u.runningBytes += t.size
+				return t
+			}
+		} else if u.closed {
+			return nil
+		}
+		u.cond.Wait()
+	}
+}
+
+func (u *uploader) worker() {
+	defer u.workersActive.Done()
+
+	for {
+		t := u.next()
+		if t == nil {
+			return
+		}
+
+		state, err := u.run(u.ctx, t)
+		slog.Debug("upload finished", "actionID", t.actionID, "size", t.size, "state", state, "error", err)
+
+		u.mu.Lock()
+		t.state, t.err = state, err
+		u.running--
+		u.runningBytes -= t.size
+		u.cond.Broadcast()
+		u.mu.Unlock()
+	}
+}
+
+// wait waits until no uploads are queued or running, or ctx is done.
+func (u *uploader) wait(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.cond.Broadcast()
+	})
+	defer stop()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for len(u.queue) > 0 || u.running > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if u.ctx.Err() != nil {
+			// Nothing will make progress anymore.
+			return u.ctx.Err()
+		}
+		u.cond.Wait()
+	}
+	return nil
+}
+
+// close stops accepting new uploads and waits for the workers to finish the
+// queued ones.
+func (u *uploader) close() {
+	u.mu.Lock()
+	u.closed = true
+	u.cond.Broadcast()
+	u.mu.Unlock()
+
+	u.workersActive.Wait()
+}
+
+// abandon cancels all queued and running uploads and returns how many there
+// were.
+func (u *uploader) abandon() int {
+	u.mu.Lock()
+	n := len(u.queue) + u.running
+	u.mu.Unlock()
+
+	u.cancel()
+	return n
+}
+
+// list returns copies of the tasks in any of the given states, ordered by
+// action ID.
+func (u *uploader) list(states ...uploadState) []uploadTask {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var tasks []uploadTask
+	for _, t := range u.tasks {
+		if slices.Contains(states, t.state) {
+			tasks = append(tasks, *t)
+		}
+	}
+	slices.SortFunc(tasks, func(a, b uploadTask) int { return strings.Compare(a.actionID, b.actionID) })
+	return tasks
+}
+
+// counts returns the number of tasks in each state.
+func (u *uploader) counts() map[uploadState]int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	counts := make(map[uploadState]int)
+	for _, t := range u.tasks {
+		counts[t.state]++
+	}
+	return counts
+}
+
+// logSummary reports the outcome of the uploads scheduled during this run,
+// and each upload which failed or was abandoned.
+func (u *uploader) logSummary() {
+	counts := u.counts()
+	if len(counts) == 0 {
+		return
+	}
+
+	slog.Info("uploads",
+		"done", counts[uploadDone],
+		"skipped", counts[uploadSkipped],
+		"failed", counts[uploadFailed],
+		"pending", counts[uploadQueued]+counts[uploadRunning],
+	)
+
+	for _, t := range u.list(uploadFailed, uploadQueued, uploadRunning) {
+		if t.state == uploadFailed {
+			slog.Debug("upload failed", "actionID", t.actionID, "size", t.size, "error", t.err)
+		} else {
+			slog.Debug("upload abandoned", "actionID", t.actionID, "size", t.size, "state", t.state)
+		}
+	}
+}
+
+// uploadQueue is a min-heap of tasks ordered by size, so that small objects
+// are uploaded first.
+type uploadQueue []*uploadTask
+
+func (q uploadQueue) Len() int { return len(q) }
+func (q uploadQueue) Less(i, j int) bool {
+	if q[i].size != q[j].size {
+		return q[i].size < q[j].size
+	}
+	return q[i].actionID < q[j].actionID
+}
+func (q uploadQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *uploadQueue) Push(x any) { *q = append(*q, x.(*uploadTask)) }
+
+func (q *uploadQueue) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return t
+}